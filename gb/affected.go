@@ -0,0 +1,148 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// --since=REV limits the build, and tests, to the targets affected by what
+// changed since the git revision REV
+var Since string
+
+// ChangedFiles lists the files, relative to the workspace, that differ
+// between rev and the working tree, including new files not yet added.
+func ChangedFiles(rev string) (files []string, err os.Error) {
+	// run in the workspace, git gives the names relative to it and leaves
+	// out everything else in the checkout
+	var out, untracked string
+	if out, err = RunExternalOutput(CWD, []string{"git", "diff", "--name-only", "--relative", rev}); err != nil {
+		err = os.NewError(fmt.Sprintf("git diff %s: %v", rev, err))
+		return
+	}
+	if untracked, err = RunExternalOutput(CWD, []string{"git", "ls-files", "--others", "--exclude-standard"}); err != nil {
+		return
+	}
+	for _, name := range strings.Split(out+"\n"+untracked, "\n") {
+		if name = strings.TrimSpace(name); name != "" {
+			files = append(files, name)
+		}
+	}
+	return
+}
+
+// AffectedTargets finds the workspace targets that own a changed file, and
+// the ones that depend on them, with -t through tests too.
+func AffectedTargets(files []string) (affected TargetSet) {
+	byDir := make(map[string][]*Package)
+	for pkg := range AllTargets() {
+		if pkg.PkgLocation() == "workspace" || pkg.PkgLocation() == "vendor" {
+			byDir[pkg.Dir] = append(byDir[pkg.Dir], pkg)
+		}
+	}
+
+	affected = make(TargetSet)
+	for _, file := range files {
+		dir, name := path.Split(file)
+		dir = path.Clean(dir)
+		if dir == "." && strings.HasSuffix(name, ".gb") {
+			// overrides.gb, hosts.gb, lock.gb and the rest configure every
+			// target
+			for _, pkgs := range byDir {
+				for _, pkg := range pkgs {
+					affected[pkg] = true
+				}
+			}
+			continue
+		}
+		// a package owns everything under its directory that isn't another
+		// package's: its sources, tests, testdata, target.gb and makefile
+		for {
+			if pkgs, ok := byDir[dir]; ok {
+				for _, pkg := range pkgs {
+					affected[pkg] = true
+				}
+				break
+			}
+			if dir == "." || dir == "/" {
+				break
+			}
+			dir, _ = path.Split(dir)
+			dir = path.Clean(dir)
+		}
+	}
+
+	for {
+		before := len(affected)
+		for pkg := range affected.RDeps() {
+			affected[pkg] = true
+		}
+		if Test {
+			for pkg := range AllTargets() {
+				for _, dp := range pkg.TestDepPkgs {
+					if affected[dp] && pkg.PkgLocation() == "workspace" {
+						affected[pkg] = true
+					}
+				}
+			}
+		}
+		if len(affected) == before {
+			break
+		}
+	}
+	return
+}
+
+// TrySince narrows ListedPkgs to the targets affected since the revision,
+// and says whether any are left to build.
+func TrySince() (any bool, err os.Error) {
+	if Since == "" {
+		return true, nil
+	}
+	var files []string
+	if files, err = ChangedFiles(Since); err != nil {
+		return
+	}
+	affected := AffectedTargets(files)
+
+	var listed []*Package
+	for _, pkg := range ListedPkgs {
+		if affected[pkg] {
+			listed = append(listed, pkg)
+		}
+	}
+	ListedPkgs = listed
+
+	switch len(listed) {
+	case 0:
+		fmt.Printf("No targets affected since %s\n", Since)
+	case 1:
+		fmt.Printf("1 target affected since %s\n", Since)
+	default:
+		fmt.Printf("%d targets affected since %s\n", len(listed), Since)
+	}
+	if Verbose {
+		for _, pkg := range listed {
+			fmt.Printf(" %s \"%s\"\n", pkg.PkgKind(), pkg.Target)
+		}
+	}
+	any = len(listed) != 0
+	return
+}
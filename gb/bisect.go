@@ -0,0 +1,364 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"exec"
+	"path"
+	"sort"
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// --bisect=GOOD..BAD finds the first commit between two git revisions where
+// the build, or with -t the tests, of the listed targets breaks
+var Bisect string
+
+// BisectRange splits GOOD..BAD. A missing BAD means HEAD.
+func BisectRange(spec string) (good, bad string, err os.Error) {
+	revs := strings.SplitN(spec, "..", 2)
+	good, bad = revs[0], "HEAD"
+	if len(revs) == 2 && revs[1] != "" {
+		bad = revs[1]
+	}
+	if good == "" {
+		err = os.NewError(fmt.Sprintf("--bisect=%s: no good revision", spec))
+	}
+	return
+}
+
+// BisectArgs splits the arguments gb was given, minus --bisect, into the
+// options and the targets it runs itself with at each step, and says whether
+// they already choose the targets with --since.
+func BisectArgs(args []string) (flags, targets []string, since bool) {
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--bisect="):
+		case strings.HasPrefix(arg, "-"):
+			if strings.HasPrefix(arg, "--since=") {
+				since = true
+			}
+			flags = append(flags, arg)
+		default:
+			targets = append(targets, arg)
+		}
+	}
+	return
+}
+
+// BisectTargets are the targets a step builds: the affected ones that exist
+// at its commit, or the listed ones if none do.
+func BisectTargets(affected, listed []string, exists func(dir string) bool) (targets []string) {
+	for _, dir := range affected {
+		if exists(dir) {
+			targets = append(targets, dir)
+		}
+	}
+	if len(targets) == 0 {
+		targets = listed
+	}
+	return
+}
+
+// BisectVerdict is what git bisect is told about a step.
+func BisectVerdict(ok, skip bool) string {
+	if skip {
+		return "skip"
+	}
+	if ok {
+		return "good"
+	}
+	return "bad"
+}
+
+// FirstBadCommit finds the commit that git bisect's output names as the first
+// bad one.
+func FirstBadCommit(out string) (sha string, found bool) {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasSuffix(strings.TrimSpace(line), "is the first bad commit") {
+			return strings.Fields(line)[0], true
+		}
+	}
+	return
+}
+
+// BisectLoop starts from the output of "git bisect start" and tells git
+// bisect, through mark, the verdict of step on each commit it checks out,
+// until it names the first bad commit.
+func BisectLoop(out string, step func() (ok, skip bool, err os.Error), mark func(verdict string) (string, os.Error)) (first string, err os.Error) {
+	for {
+		var found bool
+		if first, found = FirstBadCommit(out); found {
+			break
+		}
+		if strings.Contains(out, "first bad commit could be any of") {
+			err = os.NewError(fmt.Sprintf("git bisect couldn't narrow it down:\n%s", out))
+			return
+		}
+		var ok, skip bool
+		if ok, skip, err = step(); err != nil {
+			return
+		}
+		if out, err = mark(BisectVerdict(ok, skip)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// BisectRun checks out bad and then good with git, makes sure that step finds
+// them broken and working, and then has git bisect find the first bad commit
+// between them. Everything git doesn't track is removed before each step.
+func BisectRun(good, bad string, git func(args ...string) (string, os.Error), step func() (ok, skip bool, err os.Error)) (first string, err os.Error) {
+	try := func() (ok, skip bool, err os.Error) {
+		if _, err = git("clean", "-q", "-x", "-d", "-f"); err != nil {
+			return
+		}
+		return step()
+	}
+	check := func(rev string) (ok bool, err os.Error) {
+		if _, err = git("checkout", "-q", "-f", rev); err != nil {
+			return
+		}
+		var skip bool
+		if ok, skip, err = try(); err == nil && skip {
+			err = os.NewError(fmt.Sprintf("%s can't be tried: the workspace isn't there", rev))
+		}
+		return
+	}
+
+	// make sure the two ends are what they're said to be
+	var ok bool
+	if ok, err = check(bad); err != nil {
+		return
+	}
+	if ok {
+		err = os.NewError(fmt.Sprintf("%s isn't broken", bad))
+		return
+	}
+	if ok, err = check(good); err != nil {
+		return
+	}
+	if !ok {
+		err = os.NewError(fmt.Sprintf("%s is already broken", good))
+		return
+	}
+
+	var out string
+	if out, err = git("bisect", "start", bad, good); err != nil {
+		return
+	}
+	return BisectLoop(out, try, func(verdict string) (string, os.Error) {
+		return git("bisect", verdict)
+	})
+}
+
+// affectedDirs loads the workspace checked out in dir and returns the
+// directories of the listed targets that the changes since good affect.
+func affectedDirs(dir, good string, listed []string) (dirs []string, err os.Error) {
+	var out string
+	if out, err = RunExternalOutput(dir, []string{"git", "diff", "--name-only", "--relative", good, "HEAD"}); err != nil {
+		return
+	}
+	var files []string
+	for _, name := range strings.Split(out, "\n") {
+		if name = strings.TrimSpace(name); name != "" {
+			files = append(files, name)
+		}
+	}
+
+	err = InWorkspace(dir, func() os.Error {
+		for _, pkg := range Packages {
+			pkg.Stat()
+		}
+		for _, pkg := range Packages {
+			pkg.ResolveDeps()
+		}
+		for pkg := range AffectedTargets(files) {
+			if len(listed) == 0 {
+				dirs = append(dirs, pkg.Dir)
+				continue
+			}
+			for _, lt := range listed {
+				if !HasPathPrefix(GetRelative(lt, pkg.Dir, CWD), "..") {
+					dirs = append(dirs, pkg.Dir)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	sort.StringSlice(dirs).Sort()
+	dirs = RemoveDups(dirs)
+	return
+}
+
+// the gb being run, so the same one can be run at each step
+func gbExecutable() (gb string, err os.Error) {
+	gb = os.Args[0]
+	if !strings.Contains(gb, string(filepath.Separator)) {
+		return exec.LookPath(gb)
+	}
+	return GetAbs(gb, OSWD), nil
+}
+
+// runBisectStep runs gb in wd and says whether it succeeded, along with
+// everything it printed.
+func runBisectStep(wd, gb string, argv []string) (ok bool, out string, err os.Error) {
+	var buf bytes.Buffer
+	c := exec.Command(gb, argv...)
+	c.Dir = wd
+	c.Env = os.Environ()
+	c.Stdout = &buf
+	c.Stderr = &buf
+
+	err = c.Run()
+	out = buf.String()
+	if wmsg, isWait := err.(*os.Waitmsg); isWait {
+		ok, err = wmsg.ExitStatus() == 0, nil
+	} else if err == nil {
+		ok = true
+	}
+	return
+}
+
+func gitRev(dir, rev string) (sha string, err os.Error) {
+	if sha, err = RunExternalOutput(dir, []string{"git", "rev-parse", "--verify", rev + "^{commit}"}); err != nil {
+		err = os.NewError(fmt.Sprintf("git rev-parse %s: %v", rev, err))
+		return
+	}
+	sha = strings.TrimSpace(sha)
+	return
+}
+
+func TryBisect() (err os.Error) {
+	if Bisect == "" {
+		return
+	}
+	if Install || Nuke {
+		return os.NewError("--bisect can't be used with -i or -N")
+	}
+	if !Build {
+		// every step would pass
+		return os.NewError("--bisect can't be used with -E, a report such as --query, or other options that build nothing")
+	}
+
+	var good, bad string
+	if good, bad, err = BisectRange(Bisect); err != nil {
+		return
+	}
+	var top, prefix string
+	if top, prefix, err = GitToplevel(); err != nil {
+		return
+	}
+	if good, err = gitRev(top, good); err != nil {
+		return
+	}
+	if bad, err = gitRev(top, bad); err != nil {
+		return
+	}
+	var gb string
+	if gb, err = gbExecutable(); err != nil {
+		return
+	}
+	flags, args, since := BisectArgs(os.Args[1:])
+
+	// the listed targets, relative to the workspace, the same way RunGB
+	// finds them
+	var listed []string
+	for _, arg := range args {
+		listed = append(listed, GetRelative(CWD, path.Clean(arg), OSWD))
+	}
+	if len(listed) == 0 {
+		if rel := GetRelative(CWD, OSWD, OSWD); rel != "." {
+			listed = append(listed, rel)
+		}
+	}
+
+	// a scratch clone, so each step builds from nothing but the commit, and
+	// the workspace's own checkout and _obj directories are left alone
+	var tmp string
+	if tmp, err = ioutil.TempDir("", "gb-bisect"); err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	clone := filepath.Join(tmp, "repo")
+	if _, err = RunExternalOutput(tmp, []string{"git", "clone", "-q", "--shared", "--no-checkout", top, clone}); err != nil {
+		return
+	}
+	wd := filepath.Join(clone, prefix)
+	git := func(args ...string) (string, os.Error) {
+		return RunExternalOutput(clone, append([]string{"git"}, args...))
+	}
+
+	// the targets the changes from good to bad affect, which are the only
+	// ones worth building at each step
+	if _, err = git("checkout", "-q", "-f", bad); err != nil {
+		return
+	}
+	var affected []string
+	if !since && isDir(wd) {
+		if affected, err = affectedDirs(wd, good, listed); err != nil {
+			return
+		}
+	}
+
+	outputs := make(map[string]string)
+	commands := make(map[string][]string)
+	step := func() (ok, skip bool, err os.Error) {
+		var sha string
+		if sha, err = gitRev(clone, "HEAD"); err != nil {
+			return
+		}
+		if !isDir(wd) {
+			// the workspace isn't there to build at this commit
+			fmt.Printf("%s skip\n", sha[:7])
+			return false, true, nil
+		}
+		targets := BisectTargets(affected, listed, func(dir string) bool {
+			return isDir(filepath.Join(wd, dir))
+		})
+		argv := append(append([]string{}, flags...), targets...)
+		commands[sha] = argv
+		if ok, outputs[sha], err = runBisectStep(wd, gb, argv); err != nil {
+			return
+		}
+		fmt.Printf("%s %s\n", sha[:7], BisectVerdict(ok, false))
+		return
+	}
+
+	var first string
+	if first, err = BisectRun(good, bad, git, step); err != nil {
+		return
+	}
+
+	var summary string
+	if summary, err = git("log", "-1", "--format=%h %s", first); err != nil {
+		return
+	}
+	fmt.Printf("First bad commit: %s\n", strings.TrimSpace(summary))
+	var qargs []string
+	for _, arg := range commands[first] {
+		qargs = append(qargs, ShellQuote(arg))
+	}
+	fmt.Printf("$ gb %s\n%s", strings.Join(qargs, " "), outputs[first])
+	return
+}
@@ -94,18 +94,27 @@ func BuildPackage(pkg *Package) (err os.Error) {
 		err = RunExternal(LinkCMD, pkg.Dir, largs)
 		//durLink := time.Nanoseconds()-startLink
 		//fmt.Printf("link took %f\n", float64(durLink)/1e9)
+		if err != nil {
+			return
+		}
 		dstDir, _ := path.Split(pkg.ResultPath)
 		if Verbose {
 			fmt.Printf("Creating directory %s\n", dstDir)
 		}
-		os.MkdirAll(dstDir, 0755)
-		Copy(pkg.Dir, pkg.Target, dst)
+		if err = RunMkdirAll(dstDir); err != nil {
+			return
+		}
+		if err = Copy(pkg.Dir, pkg.Target, dst); err != nil {
+			return
+		}
 	} else {
 		dstDir, _ := path.Split(pkg.ResultPath)
 		if Verbose {
 			fmt.Printf("Creating directory %s\n", dstDir)
 		}
-		os.MkdirAll(dstDir, 0755)
+		if err = RunMkdirAll(dstDir); err != nil {
+			return
+		}
 
 		argv := []string{"gopack", "grc", dst, GetIBName()}
 		argv = append(argv, asmObjs...)
@@ -85,7 +85,7 @@ func BuildCgoPackage(pkg *Package) (err os.Error) {
 	if Verbose {
 		fmt.Printf("Creating directory %s\n", cgodir)
 	}
-	err = os.MkdirAll(cgodir, 0755)
+	err = RunMkdirAll(cgodir)
 	if err != nil {
 		return
 	}
@@ -226,23 +226,17 @@ func BuildCgoPackage(pkg *Package) (err os.Error) {
 		fmt.Printf("%v > %s\n", dynargv, "__cgo_import.c")
 	}
 
-	var dump *os.File
-	dump, err = os.Create(filepath.Join(cgodir, "__cgo_import.c"))
+	err = RunExternalToFile(CGoCMD, cgodir, dynargv, filepath.Join(cgodir, "__cgo_import.c"))
 	if err != nil {
 		return
 	}
-	err = RunExternalDump(CGoCMD, cgodir, dynargv, dump)
-	if err != nil {
-		return
-	}
-	dump.Close()
 
 	//mv __cgo_import.c _cgo_import.c
 	if Verbose {
 		fmt.Printf("%s:", cgodir)
 		fmt.Printf("Moving __cgo_import.c to _cgo_import.c\n")
 	}
-	err = os.Rename(filepath.Join(cgodir, "__cgo_import.c"), filepath.Join(cgodir, "_cgo_import.c"))
+	err = RunRename(filepath.Join(cgodir, "__cgo_import.c"), filepath.Join(cgodir, "_cgo_import.c"))
 	if err != nil {
 		return
 	}
@@ -270,14 +264,14 @@ func BuildCgoPackage(pkg *Package) (err os.Error) {
 	if Verbose {
 		fmt.Printf("Creating directory %s\n", dstDir)
 	}
-	err = os.MkdirAll(dstDir, 0755)
+	err = RunMkdirAll(dstDir)
 	if err != nil {
 		return
 	}
 	if Verbose {
 		fmt.Printf("Removing %s\n", dst)
 	}
-	os.Remove(dst)
+	RunRemove(dst)
 
 	relobjs := []string{}
 	for _, cobj := range cobjs {
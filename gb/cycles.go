@@ -0,0 +1,184 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+)
+
+// the imports that can close a cycle: those of the package, and with -t
+// those of its tests, other than of the package itself
+func cycleEdges(pkg *Package) (edges []importEdge) {
+	for _, dp := range pkg.DepPkgs {
+		edges = append(edges, importEdge{pkg, dp, false})
+	}
+	if Test {
+		for _, dp := range pkg.TestDepPkgs {
+			if dp != pkg {
+				edges = append(edges, importEdge{pkg, dp, true})
+			}
+		}
+	}
+	return
+}
+
+// ImportCycles finds, with Tarjan's algorithm, every set of targets that
+// import each other, i.e. the strongly connected components of the import
+// graph with more than one target, or with a target that imports itself.
+func ImportCycles() (cycles [][]*Package) {
+	index := make(map[*Package]int)
+	lowlink := make(map[*Package]int)
+	onStack := make(TargetSet)
+	var stack []*Package
+	next := 0
+
+	var connect func(pkg *Package)
+	connect = func(pkg *Package) {
+		index[pkg] = next
+		lowlink[pkg] = next
+		next++
+		stack = append(stack, pkg)
+		onStack[pkg] = true
+
+		selfLoop := false
+		for _, edge := range cycleEdges(pkg) {
+			if edge.To == pkg {
+				selfLoop = true
+			}
+			if _, visited := index[edge.To]; !visited {
+				connect(edge.To)
+				if lowlink[edge.To] < lowlink[pkg] {
+					lowlink[pkg] = lowlink[edge.To]
+				}
+			} else if onStack[edge.To] && index[edge.To] < lowlink[pkg] {
+				lowlink[pkg] = index[edge.To]
+			}
+		}
+
+		if lowlink[pkg] != index[pkg] {
+			return
+		}
+		var scc []*Package
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			scc = append(scc, top)
+			if top == pkg {
+				break
+			}
+		}
+		if len(scc) > 1 || selfLoop {
+			cycles = append(cycles, scc)
+		}
+	}
+
+	for _, pkg := range AllTargets().Sorted() {
+		if _, visited := index[pkg]; !visited {
+			connect(pkg)
+		}
+	}
+	return
+}
+
+// CycleThrough finds a shortest cycle of imports from the first of the
+// targets in scc back to it, and the other imports between them.
+func CycleThrough(scc []*Package) (cycle, others []importEdge) {
+	members := make(TargetSet)
+	for _, pkg := range scc {
+		members[pkg] = true
+	}
+	start := members.Sorted()[0]
+
+	parent := make(map[*Package]importEdge)
+	seen := make(TargetSet)
+	queue := []*Package{start}
+	for len(queue) != 0 && cycle == nil {
+		pkg := queue[0]
+		queue = queue[1:]
+		for _, edge := range cycleEdges(pkg) {
+			if !members[edge.To] {
+				continue
+			}
+			if edge.To == start {
+				cycle = []importEdge{edge}
+				for p := pkg; p != start; p = parent[p].From {
+					cycle = append([]importEdge{parent[p]}, cycle...)
+				}
+				break
+			}
+			if !seen[edge.To] {
+				seen[edge.To] = true
+				parent[edge.To] = edge
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+
+	inCycle := func(e importEdge) bool {
+		for _, edge := range cycle {
+			if edge.From == e.From && edge.To == e.To && edge.Test == e.Test {
+				return true
+			}
+		}
+		return false
+	}
+	for _, pkg := range members.Sorted() {
+		for _, edge := range cycleEdges(pkg) {
+			if members[edge.To] && !inCycle(edge) {
+				others = append(others, edge)
+			}
+		}
+	}
+	return
+}
+
+// CheckCycles reports every import cycle, with the file and line of each
+// import in it.
+func CheckCycles() (err os.Error) {
+	cycles := ImportCycles()
+	if len(cycles) == 0 {
+		return
+	}
+
+	for _, scc := range cycles {
+		cycle, others := CycleThrough(scc)
+		var targets []string
+		for _, edge := range cycle {
+			targets = append(targets, fmt.Sprintf("\"%s\"", edge.From.Target))
+		}
+		ErrLog.Printf("Import cycle through %s:\n", strings.Join(targets, ", "))
+		for _, edge := range cycle {
+			fmt.Fprintf(os.Stderr, "\t\"%s\" %v\n", edge.From.Target, edge)
+		}
+		if len(others) != 0 {
+			fmt.Fprintf(os.Stderr, " other imports among them:\n")
+			for _, edge := range others {
+				fmt.Fprintf(os.Stderr, "\t\"%s\" %v\n", edge.From.Target, edge)
+			}
+		}
+	}
+
+	if len(cycles) == 1 {
+		err = os.NewError("1 import cycle")
+	} else {
+		err = os.NewError(fmt.Sprintf("%d import cycles", len(cycles)))
+	}
+	return
+}
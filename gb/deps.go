@@ -18,6 +18,7 @@ package main
 
 import (
 	"os"
+	"path"
 	"bytes"
 	"bufio"
 	"strings"
@@ -52,18 +53,66 @@ func GetDeps(source string) (pkg, target string, deps, funcs, cflags, ldflags []
 	return
 }
 
+// ImportLine finds the line of file that imports dep, quoted, or returns 0.
+func ImportLine(file, dep string) (line int) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ImportsOnly)
+	if err != nil {
+		return
+	}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			if is, ok := spec.(*ast.ImportSpec); ok && string(is.Path.Value) == dep {
+				return fset.Position(is.Pos()).Line
+			}
+		}
+	}
+	return
+}
+
+// RemoveDups keeps the first occurrence of each item, so that flag order
+// survives and generated files come out the same every time.
 func RemoveDups(list []string) (newlist []string) {
 	m := make(map[string]bool)
+	newlist = make([]string, 0)
 	for _, item := range list {
+		if m[item] {
+			continue
+		}
 		m[item] = true
-	}
-	newlist = make([]string, 0)
-	for item, _ := range m {
 		newlist = append(newlist, item)
 	}
 	return
 }
 
+// DirDeps returns the imports of the non-test go source in dir.
+func DirDeps(dir string) (deps []string) {
+	fdir, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := fdir.Readdirnames(-1)
+	fdir.Close()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") || !FilterFlag(name) {
+			continue
+		}
+		_, _, fdeps, _, _, _, ferr := GetDeps(path.Join(dir, name))
+		if ferr == nil {
+			deps = append(deps, fdeps...)
+		}
+	}
+	deps = RemoveDups(deps)
+	return
+}
+
 type Walker struct {
 	Name       string
 	Target     string
@@ -82,9 +82,145 @@ comment.
 If you are working on something in $GOROOT/src and something outside at the 
 same time, you can run gb -R to build dependencies in $GOROOT.
 
+Packages in $GOPATH that the workspace imports, directly or through each
+other, are scanned too. If one's source is newer than its archive in
+$GOPATH/pkg/$GOOS_$GOARCH, or one of its own dependencies was rebuilt, gb
+rebuilds it there before building the workspace. "-c", "-N" and "-i" leave
+them alone unless gb is run from that $GOPATH, or with -R.
+
+Workspace targets are installed into the first $GOPATH entry, or $GOROOT if
+$GOPATH is not set. To install into another entry, name it in
+$GB_INSTALL_GOPATH for one run, or in 'gopath.gb' in the workspace root. The
+choice also decides what "-N" removes, what "-s" reports as installed, and
+the TARGDIR of makefiles generated by "-M".
+
+To build without access to the internet, set $GB_MIRROR to a directory of
+git or hg repositories (bare or not) or plain source trees, laid out by
+import path, e.g. $GB_MIRROR/github.com/user/project. Remote packages that
+the workspace imports are then checked out from the mirror into "_mirror_",
+at the revision recorded in "lock.gb" if there is one, and built as ordinary
+targets instead of being goinstalled. With "-G", the checkouts are redone.
+
+Remote imports are recognized by the same host patterns goinstall uses. To
+import from other hosts, list them in 'hosts.gb', one per line as
+	<pattern> <vcs> <url>
+where the first group of the regular expression <pattern> is the repository
+root and {root}, {1}, {2}, etc. in <url> are replaced with the groups it
+matched, e.g.
+	^(code\.example\.com/[a-z0-9_]+)(/.*)?$ git ssh://git@code.example.com/{root}.git
+gb clones such repositories itself before running goinstall on them.
+
+To control which third-party packages may be imported, list rules in
+'policy.gb', one per line, as "allow <prefix>" or "deny <prefix>", where a
+prefix is an import path or "*". Each import from outside the workspace and
+$GOROOT, including vendored, mirrored and $GOPATH packages, is matched
+against the rule with the longest prefix; if none matches, it is allowed
+unless there are allow rules. Any import that isn't allowed is reported with
+the file that makes it, and nothing is built.
+
+To keep low-level targets from importing higher-level ones, list rules in
+'layers.gb', one per line, as "deny <importer> <imported>". Each side is a
+target or directory prefix, or "*", and may be qualified as "cmd:<prefix>"
+or "pkg:<prefix>", e.g.
+	deny core ui
+	deny * cmd:*
+An import that breaks a rule is reported with the file that makes it, and
+nothing is built.
+
+To build a patched copy of a remote package in place of the original, list
+it in 'overrides.gb' as
+	<import path> <dir>
+Imports of <import path> then resolve to the package in <dir>, whatever its
+own target is, and its archive is also put under <import path> in _obj and
+when installed. "-S" shows each overridden import.
+
 To include extra files in a distribution, create a file 'dist.gb' that lists
 the additional files to copy.
 
+The makefiles and build script written by "-M" come from built-in templates.
+To use your own, put a template in 'makecmd.gb', 'makepkg.gb' or
+'buildscript.gb' in the workspace root. Makefile templates are given the
+target's Dir, Target, IsCmd, GoFiles, AsmObjs, CGoFiles, CObjs, CGoCFlags,
+CGoLDFlags, TestSources, Deps, LocalDeps, LocalTestDeps, GBROOT, BuildDirPkg,
+BuildDirCmd, CopyLocal, GOPATHS and InstallDir. The build script template is given
+GoInstalls, the remote packages, Fetches, the Root, VCS, URL and Clone
+command of repositories from 'hosts.gb', and Targets, the makefile data for each
+target in topological dependence order.
+
+
+To answer questions about the target graph, "--query=EXPR" prints the
+targets that EXPR selects instead of building. The language has
+	deps(e), rdeps(e)     what e imports, and what imports e, transitively
+	testdeps(e)           like deps(e), also following the tests' imports
+	kind(k, e)            the cmds, pkgs or cgo pkgs in e
+	loc(l, e)             the targets of e in the workspace, vendor, mirror,
+	                      gopath or goroot
+	stale(e)              the targets of e that need to be built
+	e | e, e & e, e - e   union, intersection and difference
+	*                     every target
+where a target is named by its target name or directory, and "dir/..."
+names all of them under dir. For example,
+	gb "--query=kind(cmd, rdeps(pkg/auth) - rdeps(pkg/legacy))"
+lists the cmds that depend on pkg/auth but not on pkg/legacy. With
+"--format=dirs" it prints directories instead of names, and with
+"--format=json" it prints each target's name, directory, kind, location
+and staleness. Neither this nor the reports below build or test anything;
+"-t" only makes them follow the imports of tests too.
+
+For each import that is neither a workspace target nor installed in
+$GOROOT or $GOPATH, gb reports the file and line that makes it, whether "-g"
+would fetch it, and any workspace targets with a similar name, the same last
+element, or in the imported directory but renamed with target.gb. Nothing
+is built while any such import is left.
+
+If targets import each other, gb reports every such cycle before building,
+with the file and line of each import in it, and builds nothing. With "-t",
+imports made by tests count too.
+
+To see why one target depends on another, "--path=FROM,TO" prints the
+shortest chain of imports from FROM to TO, each with the source file that
+makes the import, and "--allpaths=FROM,TO" prints every chain. FROM and TO
+are queries, so "--path=cmd/...,pkg/sqlite" works too. With "-t", the
+imports of FROM's tests are followed as well. If a target is in both FROM
+and TO, "--path" says so instead.
+
+"--files=text", "--files=json" and "--files=dot" print the imports of each
+source file in the relevant targets, including test files with "-t", as
+text, JSON or a graphviz graph. "--singleuse" lists, for each relevant
+target with more than one source file, the imports that only one file
+makes, which are good candidates for moving out of the package.
+
+"--unreachable" lists the workspace packages that no workspace cmd depends
+on, directly or not, with their size in source lines. With "-t", packages
+that a test depends on are not listed.
+
+"--since=REV" narrows the relevant targets to those affected by the files
+that changed, or were created, since the git revision REV: the target whose
+directory is the closest one above each changed file, and every target that
+depends on them, or with "-t" whose tests do. A change to a .gb file in the
+workspace root affects every target. Only those are built, tested or
+installed, so "gb -t --since=origin/master" checks just what a branch could
+have broken.
+
+"--graphdiff=REV1..REV2" scans the workspace as it was at two revisions of
+its git repository and prints the targets added, removed or renamed, the
+imports between targets added or removed, and the imports from outside the
+workspace and $GOROOT that appeared or went away. Each revision is checked
+out in a temporary git worktree and read with its own .gb files, the same
+way gb reads the working tree. "--graphdiff=REV" compares REV with the
+working tree.
+
+"--bisect=GOOD..BAD" drives git bisect to find the first commit after GOOD
+where gb, run with the same targets and options, fails to build them, or with
+"-t" fails their tests. Each step runs in a scratch clone of the repository,
+emptied of everything git doesn't track first, so no _obj directory,
+generated makefile or workspace.gb left over from another commit gets in the
+way. Only the listed targets that the changes from GOOD to BAD affect are
+built, GOOD and BAD included, or all the listed targets at a commit where
+none of those exist. GOOD has to build and BAD has to fail, and both need
+the workspace to be there. gb prints the first bad commit and what gb printed
+when it failed there. BAD defaults to HEAD. Options that build nothing, such
+as "-E" and the reports above, can't be used with "--bisect".
 
 Options:
  -i		Install build pkgs and cmds to $GOROOT/pkg/$GOOS_$GOARCH and
@@ -101,6 +237,45 @@ Options:
 		one of the following websites: googlecode.com, github.com,
 		bitbucket.org and launchpad.net.		 
 
+ -V		Vendor remote packages. The source of every goinstallable package
+		imported, directly or indirectly, by the relevant targets is
+		copied from $GOPATH/src or $GOROOT/src/pkg into the directory
+		"vendor/<import path>" in the workspace root. With "-g",
+		packages that haven't been goinstalled yet are fetched first.
+		Targets under "vendor" are named by their import path, and are
+		used to satisfy imports ahead of anything in $GOPATH or
+		$GOROOT, so builds no longer depend on what each machine has
+		installed.
+
+ -K		Write "lock.gb" in the workspace root. For each remote import
+		needed by the relevant targets, directly or indirectly, it
+		records the import path, the version control system implied by
+		the import path, the revision of the source that would be used,
+		preferring a vendored copy, and a hash of that source. The
+		revision is "-" for a vendored copy, or if it can't be told.
+
+ -k		Verify the remote packages against "lock.gb" before building. The
+		build fails if any source doesn't match its recorded hash or
+		revision, or if a remote import isn't in the lock file.
+
+ -A		Audit the imports from outside the workspace and $GOROOT. For each
+		relevant target, list every such import, the first file that
+		makes it, and whether 'policy.gb' allows it, without building.
+
+ -E		Explain, without building, why each relevant target needs to be
+		built: its result file is missing, a source file is newer than
+		it, a dependency will be or was rebuilt, an installed $GOROOT
+		or $GOPATH package it imports is newer, or "-g"/"-G" forced it.
+		With "-i", targets that only need installing are explained too.
+
+ -u		Name packages after the repository they are checked out from.
+		For a package in a git or hg checkout whose name is not set with
+		target.gb, a //target: comment or a makefile, the target is the
+		import path of the "origin" or "default" remote, followed by the
+		package's directory within the checkout, e.g.
+		"github.com/team/proj/sub". The whole workspace then builds
+		with the names goinstall would use.
+
  -p		Attempt to build a package immediately once its dependencies are
 		met and a processor is free.
 
@@ -121,7 +296,10 @@ Options:
  -v		Verbose. Print out all build instructions used.
 
  -m		Use makefiles. If this flag is set, and a target contains a
-		makefile, that makefile will be used to build.
+		makefile, that makefile will be used to build. gb reads the
+		TARG, GOFILES, CGOFILES and OFILES variables from the makefile,
+		uses TARG as the target name, and warns about any files that it
+		would compile but the makefile omits, or vice versa.
 
  -M		Generate makefiles and a build script. In each relevant target,
 		create a makefile that supports incremental building with the
@@ -129,10 +307,22 @@ Options:
 		makefiles in a topological order, ensuring that running "./build"
 		will always result in a correct build.
 
- -f		For use with "-M", force overwriting of makefiles. Otherwise
+ -X		Generate a standalone build script, "build.sh", in the root. It
+		contains the exact compiler, assembler, packer, linker, cgo and
+		gcc command lines that gb would run to build the relevant
+		targets from scratch, in topological dependence order, so the
+		targets can be rebuilt from a distribution with neither gb nor
+		the $GOROOT makefiles available.
+
+ -f		For use with "-M" or "-X", force overwriting of makefiles. Otherwise
 		you will be prompted when attempting to create a makefile for
 		a target that already has one.
 
+ -U		Rewrite, without prompting, any makefile that was generated by
+		"-M" and no longer matches what "-M" would generate now, for
+		example because a source file or a dependency was added. Stale
+		generated makefiles are also marked in the output of "-s".
+
  -F		Run gofmt on all source for relevant targets.
 
  -P		Build/clean/install only packages. Useful if you have a set of
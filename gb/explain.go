@@ -0,0 +1,115 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// ExplainBuild gives the reasons, from the same times Touched compares, that
+// this target needs to be built.
+func (this *Package) ExplainBuild() (reasons []string) {
+	if this.ForcedBy != "" {
+		reasons = append(reasons, this.ForcedBy)
+	}
+	if this.BinTime == 0 {
+		reasons = append(reasons, fmt.Sprintf("%s is missing", this.ResultPath))
+		return
+	}
+	for _, src := range this.Sources {
+		if t, err := StatTime(path.Join(this.Dir, src)); err == nil && t > this.BinTime {
+			reasons = append(reasons, fmt.Sprintf("%s is newer than %s", path.Join(this.Dir, src), this.ResultPath))
+		}
+	}
+	for _, pkg := range this.DepPkgs {
+		if pkg.NeedsBuild {
+			reasons = append(reasons, fmt.Sprintf("its dependency \"%s\" will be rebuilt", pkg.Target))
+		} else if pkg.BinTime > this.BinTime {
+			reasons = append(reasons, fmt.Sprintf("its dependency \"%s\" was rebuilt since", pkg.Target))
+		}
+	}
+	if this.GOROOTPkgTime > this.BinTime {
+		for _, dep := range this.Deps {
+			if _, ok := LookupImport(dep); ok {
+				continue
+			}
+			if exists, when := PkgExistsInGOROOT(dep); exists && when > this.BinTime {
+				reasons = append(reasons, fmt.Sprintf("the installed %s is newer than %s", dep, this.ResultPath))
+			}
+		}
+	}
+	return
+}
+
+// ExplainInstall gives the reasons this target needs to be installed.
+func (this *Package) ExplainInstall() (reasons []string) {
+	switch {
+	case this.NeedsBuild:
+		reasons = append(reasons, "it will be rebuilt")
+	case this.InstTime == 0:
+		reasons = append(reasons, fmt.Sprintf("%s is missing", this.InstallPath))
+	case this.InstTime < this.BinTime:
+		reasons = append(reasons, fmt.Sprintf("%s is newer than %s", this.ResultPath, this.InstallPath))
+	default:
+		for _, pkg := range this.DepPkgs {
+			if pkg.NeedsInstall {
+				reasons = append(reasons, fmt.Sprintf("its dependency \"%s\" will be installed", pkg.Target))
+			}
+		}
+	}
+	return
+}
+
+func (this *Package) Explain() {
+	if this.explained {
+		return
+	}
+	this.explained = true
+
+	for _, pkg := range this.DepPkgs {
+		pkg.Explain()
+	}
+
+	if !this.Active || !this.NeedsBuild && !this.NeedsInstall {
+		return
+	}
+
+	explain := func(what string, reasons []string) {
+		fmt.Printf("in %s: %s \"%s\" needs %s\n", this.Dir, this.PkgKind(), this.Target, what)
+		if len(reasons) == 0 {
+			reasons = []string{"of something gb can't tell"}
+		}
+		for _, reason := range reasons {
+			fmt.Printf("\tbecause %s\n", reason)
+		}
+	}
+	if this.NeedsBuild {
+		explain("building", this.ExplainBuild())
+	} else if Install {
+		explain("installing", this.ExplainInstall())
+	}
+}
+
+func TryExplain() {
+	if !Explain {
+		return
+	}
+	for _, pkg := range ListedPkgs {
+		pkg.Explain()
+	}
+}
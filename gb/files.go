@@ -23,6 +23,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"path/filepath"
 )
 
 var (
@@ -153,12 +154,22 @@ func PkgExistsInGOROOT(target string) (exists bool, time int64) {
 		target = target[0 : len(target)-1]
 	}
 
-	pkgbin := path.Join(GetInstallDirPkg(), target)
-	pkgbin += ".a"
+	// gb installs into GetInstallDirPkg(), but goinstall may have put it in
+	// any $GOPATH entry, and the standard packages are in $GOROOT
+	objdsts := append([]string{GetInstallDirPkg()}, GOPATH_OBJDSTS...)
+	objdsts = append(objdsts, path.Join(GOROOT, "pkg", GOOS+"_"+GOARCH))
+	for _, objdst := range objdsts {
+		pkgbin := path.Join(objdst, target)
+		pkgbin += ".a"
 
-	time, err := StatTime(pkgbin)
+		var err os.Error
+		time, err = StatTime(pkgbin)
 
-	exists = err == nil
+		exists = err == nil
+		if exists {
+			return
+		}
+	}
 
 	return
 }
@@ -178,13 +189,47 @@ func LineChan(f string, ch chan<- string) (err os.Error) {
 	return
 }
 
+// ReadConfig calls line with the fields of each line of the workspace file
+// name, skipping blank lines and # comments, and puts "name:lineno: " in
+// front of any error that line returns. A missing file has no lines.
+func ReadConfig(name string, line func(lineno int, fields []string) os.Error) (err os.Error) {
+	var fin *os.File
+	if fin, err = os.Open(filepath.Join(CWD, name)); err != nil {
+		return nil
+	}
+	defer fin.Close()
+
+	br := bufio.NewReader(fin)
+	for lineno := 1; ; lineno++ {
+		text, rerr := br.ReadString('\n')
+		if rerr != nil && rerr != os.EOF {
+			return rerr
+		}
+		text = strings.TrimSpace(text)
+		if text != "" && !strings.HasPrefix(text, "#") {
+			if err = line(lineno, strings.Fields(text)); err != nil {
+				return os.NewError(fmt.Sprintf("%s:%d: %v", name, lineno, err))
+			}
+		}
+		if rerr == os.EOF {
+			break
+		}
+	}
+	return
+}
+
 func ReadOneLine(file string) (line string, err os.Error) {
 	var fin *os.File
 	fin, err = os.Open(file)
 	if err == nil {
+		defer fin.Close()
 		bfrd := bufio.NewReader(fin)
 		line, err = bfrd.ReadString('\n')
 		line = strings.TrimSpace(line)
+		if err == os.EOF && line != "" {
+			// the line needn't end with a newline
+			err = nil
+		}
 	}
 	return
 }
@@ -256,7 +301,7 @@ func CopyTheHardWay(cwd, src, dst string) (err os.Error) {
 }
 
 func Copy(cwd, src, dst string) (err os.Error) {
-	if CopyCMD == "" {
+	if CopyCMD == "" && ScriptFile == nil {
 		return CopyTheHardWay(cwd, src, dst)
 	}
 
@@ -270,3 +315,45 @@ func Copy(cwd, src, dst string) (err os.Error) {
 
 	return
 }
+
+// CopyDir copies the regular, non-hidden files in src to dst.
+func CopyDir(src, dst string) (err os.Error) {
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return
+	}
+	var dir *os.File
+	if dir, err = os.Open(src); err != nil {
+		return
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return
+	}
+	absdst := GetAbs(dst, CWD)
+	for _, info := range infos {
+		if !info.IsRegular() || strings.HasPrefix(info.Name, ".") {
+			continue
+		}
+		if err = CopyTheHardWay(src, info.Name, path.Join(absdst, info.Name)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// CopyTree copies src to dst, including all non-hidden subdirectories.
+func CopyTree(src, dst string) (err os.Error) {
+	if err = CopyDir(src, dst); err != nil {
+		return
+	}
+	for _, subdir := range GetSubDirs(src) {
+		if strings.HasPrefix(subdir, ".") {
+			continue
+		}
+		if err = CopyTree(path.Join(src, subdir), path.Join(dst, subdir)); err != nil {
+			return
+		}
+	}
+	return
+}
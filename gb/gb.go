@@ -22,6 +22,7 @@ import (
 	"os"
 	"fmt"
 	"path"
+	"path/filepath"
 	"log"
 )
 
@@ -35,11 +36,19 @@ var Install, //-i
 	Test, //-t
 	Exclusive, //-e
 	BuildGOROOT, //-R
+	VCSTargets, //-u
+	Audit, //-A
+	Explain, //-E
 	GoInstall, //-gG
 	GoInstallUpdate, //-G
 	Concurrent, //-p
 	Verbose, //-v
 	GenMake, //-M
+	GenScript, //-X
+	UpdateMakefiles, //-U
+	Vendor, //-V
+	WriteLockFile, //-K
+	VerifyLockFile, //-k
 	Build, //-b
 	Force, //-f
 	Makefiles, //-m
@@ -49,6 +58,9 @@ var Install, //-i
 	Distribution, //-D
 	Workspace bool //-W
 
+// a --option asked for a report about the targets instead of a build
+var Reporting bool
+
 var IncludeDir string
 var GCArgs []string
 var GLArgs []string
@@ -64,6 +76,9 @@ var TestArgs []string
 var BrokenMsg []string
 var ReturnFailCode bool
 
+// scan the imports of test source even when not testing
+var ScanTestDeps bool
+
 var RunningInGOROOT bool
 var RunningInGOPATH string
 
@@ -95,6 +110,7 @@ func ScanDirectory(base, dir string) (err2 os.Error) {
 		basedir == "_test" ||
 		basedir == "_cgo" ||
 		basedir == "_dist_" ||
+		basedir == MirrorWorkDir ||
 		basedir == "bin" ||
 		(basedir != "." && strings.HasPrefix(basedir, ".")) {
 		return
@@ -121,7 +137,9 @@ func ScanDirectory(base, dir string) (err2 os.Error) {
 			key += "-cmd"
 		}
 		if dup, exists := Packages[key]; exists {
-			if GetAbs(dup.Dir, CWD) != GetAbs(pkg.Dir, CWD) {
+			if dup.IsVendored && pkg.IsInGOPATH != "" {
+				// the vendored copy wins
+			} else if GetAbs(dup.Dir, CWD) != GetAbs(pkg.Dir, CWD) {
 				ErrLog.Printf("Duplicate target: %s\n in %s\n in %s\n", pkg.Target, dup.Dir, pkg.Dir)
 			}
 		} else {
@@ -146,7 +164,12 @@ func ScanDirectory(base, dir string) (err2 os.Error) {
 		subdirs := GetSubDirs(dir)
 		for _, subdir := range subdirs {
 			if subdir != "src" {
-				ScanDirectory(path.Join(base, subdir), path.Join(dir, subdir))
+				subbase := path.Join(base, subdir)
+				if dir == "." && subdir == VendorDir {
+					// vendored targets are named by their import path
+					subbase = ""
+				}
+				ScanDirectory(subbase, path.Join(dir, subdir))
 			}
 		}
 	} else {
@@ -155,6 +178,88 @@ func ScanDirectory(base, dir string) (err2 os.Error) {
 	return
 }
 
+// LoadWorkspace scans the workspace in CWD along with what its .gb files
+// configure: extra remote hosts, overrides, policy and layering rules, and the
+// mirrored and $GOPATH packages it imports.
+func LoadWorkspace() (err os.Error) {
+	if err = LoadRemoteHosts(); err != nil {
+		return
+	}
+	if err = ScanDirectory(".", "."); err != nil {
+		return
+	}
+	if err = LoadOverrides(); err != nil {
+		return
+	}
+	if err = LoadPolicy(); err != nil {
+		return
+	}
+	if err = LoadLayers(); err != nil {
+		return
+	}
+	if err = ScanMirror(); err != nil {
+		return
+	}
+	err = ScanGOPATHDeps()
+	return
+}
+
+// ScanGOPATHDeps adds the $GOPATH packages that the workspace imports,
+// directly or through each other, so that any whose source is newer than
+// the archive in $GOPATH/pkg is rebuilt there first.
+func ScanGOPATHDeps() (err os.Error) {
+	if len(GOPATH_SRCROOTS) == 0 || BuildGOROOT {
+		return
+	}
+
+	var todo []*Package
+	for _, pkg := range Packages {
+		todo = append(todo, pkg)
+	}
+
+	tried := make(map[string]bool)
+	for len(todo) != 0 {
+		pkg := todo[0]
+		todo = todo[1:]
+
+		deps := pkg.Deps
+		if Test && pkg.IsInGOPATH == "" {
+			deps = append(append([]string{}, deps...), pkg.TestDeps...)
+		}
+		for _, dep := range deps {
+			if dep == "\"C\"" || tried[dep] {
+				continue
+			}
+			tried[dep] = true
+			if _, ok := LookupImport(dep); ok {
+				continue
+			}
+			if GoInstallUpdate && IsGoInstallable(dep) {
+				// goinstall -u will bring it up to date
+				continue
+			}
+			target := strings.Trim(dep, "\"")
+			for _, srcroot := range GOPATH_SRCROOTS {
+				dir := filepath.Join(srcroot, target)
+				if !isDir(dir) {
+					continue
+				}
+				gpkg, perr := NewPackage("", dir)
+				if perr != nil || gpkg.IsCmd || gpkg.Target != target {
+					continue
+				}
+				if Verbose {
+					fmt.Printf("Found \"%s\" in %s\n", target, gpkg.IsInGOPATH)
+				}
+				Packages[dep] = gpkg
+				todo = append(todo, gpkg)
+				break
+			}
+		}
+	}
+	return
+}
+
 func ValidateDir(name string) {
 	if Exclusive {
 		ValidatedDirs[name] = true
@@ -244,6 +349,10 @@ func TryGoFMT() (err os.Error) {
 
 func TryGenMake() (err os.Error) {
 	if GenMake {
+		if err = LoadTemplates(); err != nil {
+			return
+		}
+
 		_, ferr := os.Stat("build")
 
 		genBuild := true
@@ -260,44 +369,37 @@ func TryGenMake() (err os.Error) {
 
 		if genBuild {
 			fmt.Printf("(in .) generating build script\n")
-			var buildFile *os.File
-			buildFile, err = os.Create("build")
-			bwrite := func(format string, args ...interface{}) {
-				if err != nil {
-					return
-				}
-				_, err = fmt.Fprintf(buildFile, format, args...)
-			}
-			bwrite("# Build script generated by gb: http://go-gb.googlecode.com\n")
-			bwrite("# gb provides configuration-free building and distributing\n")
-			bwrite("\n")
-			bwrite("echo \"Build script generated by gb: http://go-gb.googlecode.com\" \n")
 
+			var data BuildData
 			gm := make(map[string]bool)
 			for _, pkg := range ListedPkgs {
 				pkg.CollectGoInstall(gm)
 			}
-			bwrite("if [ \"$1\" = \"goinstall\" ]; then\n")
-			bwrite("echo Running goinstall \\\n")
+			fetched := make(map[string]bool)
 			for gp := range gm {
-				if _, ok := Packages[gp]; ok {
+				if _, ok := LookupImport(gp); ok {
 					continue
 				}
-				gp = strings.Trim(gp, "\"")
-				bwrite("&& echo \"goinstall %s\" \\\n", gp)
-				bwrite("&& goinstall %s \\\n", gp)
+				target := strings.Trim(gp, "\"")
+				data.GoInstalls = append(data.GoInstalls, target)
+				if vcs, root, url, ok := RemoteURL(target); ok && !fetched[root] {
+					fetched[root] = true
+					data.Fetches = append(data.Fetches, FetchData{root, vcs, url, strings.Join(CloneArgs(vcs, ShellQuote(url), ""), " ")})
+				}
 			}
-			bwrite("\n")
-			bwrite("else\n")
-			bwrite("echo Building \\\n")
 			for _, pkg := range ListedPkgs {
-				pkg.AddToBuild(buildFile)
+				pkg.AddToBuild(&data)
+			}
+
+			var buildFile *os.File
+			buildFile, err = os.Create("build")
+			if err != nil {
+				return
 			}
-			bwrite("\n")
-			bwrite("fi\n")
-			bwrite("\n# The makefiles above are invoked in topological dependence order\n")
 
+			err = BuildTemplate.Execute(buildFile, data)
 			if err != nil {
+				buildFile.Close()
 				return
 			}
 
@@ -317,6 +419,22 @@ func TryGenMake() (err os.Error) {
 	return
 }
 
+func TryUpdateMakefiles() (err os.Error) {
+	if UpdateMakefiles && !GenMake {
+		for _, pkg := range ListedPkgs {
+			if !pkg.StaleMakefile || !pkg.Active {
+				continue
+			}
+			fmt.Printf("(in %s) updating stale makefile for \"%s\"\n", pkg.Dir, pkg.Target)
+			if err = pkg.WriteMakefile(); err != nil {
+				return
+			}
+			pkg.StaleMakefile = false
+		}
+	}
+	return
+}
+
 func TryDistribution() (err os.Error) {
 	if Distribution {
 		ch := make(chan string)
@@ -330,6 +448,7 @@ func TryDistribution() (err os.Error) {
 				return false
 			}
 			tryFile("build")
+			tryFile(ScriptName)
 			tryFile("README")
 
 			LineChan("dist.gb", ch)
@@ -385,7 +504,7 @@ func TryBuild() {
 }
 
 func TryTest() (err os.Error) {
-	if Test {
+	if Test && !Explain && !Reporting {
 		for _, pkg := range ListedPkgs {
 			if len(pkg.TestSources) != 0 {
 				err = pkg.Test()
@@ -399,7 +518,7 @@ func TryTest() (err os.Error) {
 }
 
 func TryInstall() {
-	if Install {
+	if Install && !Explain && !Reporting {
 		brokenMsg := []string{}
 		for _, pkg := range ListedPkgs {
 			err := pkg.Install()
@@ -416,20 +535,45 @@ func TryInstall() {
 	}
 }
 
+// SetBuild decides from the other flags whether the listed targets get built.
+func SetBuild() {
+	Build = Build || (!GenMake && !GenScript && !Vendor && !WriteLockFile && !Clean && !GoFMT && !Scan && !Workspace && !Audit && !Explain && !Reporting) || (Makefiles && !Clean) || Install || Test
+	// -E only explains what -b, -i or -t would do, and a report only reads
+	// the targets; with -t it counts their test imports too
+	Build = Build && !Explain && !Reporting
+}
+
+// SetScanTestDeps decides whether the imports of tests are read without -t:
+// generated makefiles list them, and the reports can follow them.
+func SetScanTestDeps() {
+	ScanTestDeps = GenMake || UpdateMakefiles || Scan || Reporting
+}
+
 func RunGB() (err os.Error) {
-	Build = Build || (!GenMake && !Clean && !GoFMT && !Scan && !Workspace) || (Makefiles && !Clean) || Install || Test
+	SetBuild()
 
 	DoPkgs, DoCmds = DoPkgs || (!DoPkgs && !DoCmds), DoCmds || (!DoPkgs && !DoCmds)
 
+	SetScanTestDeps()
+
 	ListedDirs = make(map[string]bool)
 	ValidatedDirs = make(map[string]bool)
 
 	args := os.Args[1:len(os.Args)]
 
-	err = ScanDirectory(".", ".")
-	if err != nil {
+	if Bisect != "" {
+		// every step is a separate run of gb, in a clone of the repository
+		return TryBisect()
+	}
+
+	if err = LoadWorkspace(); err != nil {
 		return
 	}
+	if GraphDiff != "" {
+		// whole workspaces are compared, so nothing about the listed targets
+		// matters, and a new cycle or broken rule is part of what it shows
+		return TryGraphDiff()
+	}
 	if BuildGOROOT {
 		fmt.Printf("Scanning %s...", path.Join("GOROOT", "src"))
 		ScanDirectory("", path.Join(GOROOT, "src"))
@@ -492,15 +636,33 @@ func RunGB() (err os.Error) {
 		pkg.ResolveDeps()
 	}
 
-	for _, pkg := range Packages {
-		cycle := pkg.DetectCycles()
-		if cycle != nil {
-			var targets []string
-			for _, cp := range cycle {
-				targets = append(targets, cp.Target)
-			}
-			err = os.NewError(fmt.Sprintf("Cycle detected: %v", targets))
-			return
+	if unresolved := ReportUnresolved(); unresolved != 0 && Build {
+		// the compiler would only stop on them later, and say less
+		err = os.NewError(fmt.Sprintf("%d imports can't be resolved", unresolved))
+		return
+	}
+
+	if PolicyViolations != 0 && !Audit {
+		err = os.NewError(fmt.Sprintf("%d imports not allowed by %s", PolicyViolations, PolicyFile))
+		return
+	}
+	if LayerViolations != 0 {
+		err = os.NewError(fmt.Sprintf("%d imports break the rules in %s", LayerViolations, LayersFile))
+		return
+	}
+
+	if err = CheckCycles(); err != nil {
+		return
+	}
+
+	var anyAffected bool
+	if anyAffected, err = TrySince(); err != nil || !anyAffected {
+		return
+	}
+
+	if Scan || UpdateMakefiles {
+		for _, pkg := range Packages {
+			pkg.CheckMakefile()
 		}
 	}
 
@@ -510,6 +672,26 @@ func RunGB() (err os.Error) {
 
 	TryScan()
 
+	TryAudit()
+
+	TryExplain()
+
+	if err = TryQuery(); err != nil {
+		return
+	}
+
+	if err = TryPath(); err != nil {
+		return
+	}
+
+	if err = TryFileGraph(); err != nil {
+		return
+	}
+
+	TrySingleUse()
+
+	TryUnreachable()
+
 	if err = TryGoFMT(); err != nil {
 		return
 	}
@@ -518,6 +700,26 @@ func RunGB() (err os.Error) {
 		return
 	}
 
+	if err = TryUpdateMakefiles(); err != nil {
+		return
+	}
+
+	if err = TryGenScript(); err != nil {
+		return
+	}
+
+	if err = TryVendor(); err != nil {
+		return
+	}
+
+	if err = TryLock(); err != nil {
+		return
+	}
+
+	if err = TryVerifyLock(); err != nil {
+		return
+	}
+
 	if err = TryDistribution(); err != nil {
 		return
 	}
@@ -565,12 +767,74 @@ func RunGB() (err os.Error) {
 	return
 }
 
+// CheckLongFlag handles a --name=value option.
+func CheckLongFlag(opt string) bool {
+	name, value := opt, ""
+	if i := strings.Index(opt, "="); i != -1 {
+		name, value = opt[:i], opt[i+1:]
+	}
+	switch name {
+	case "singleuse":
+		// takes no value
+		SingleUse = true
+		Reporting = true
+		return value == ""
+	case "unreachable":
+		Unreachable = true
+		Reporting = true
+		return value == ""
+	case "files":
+		switch value {
+		case "text", "json", "dot":
+			FileGraph = value
+			Reporting = true
+		default:
+			ErrLog.Printf("Unknown format %q\n", value)
+			return false
+		}
+	case "since":
+		Since = value
+	case "graphdiff":
+		GraphDiff = value
+		Reporting = true
+	case "bisect":
+		// the steps build, so this isn't a report
+		Bisect = value
+	case "query":
+		Query = value
+		Reporting = true
+	case "path", "allpaths":
+		PathQuery = value
+		AllPaths = name == "allpaths"
+		Reporting = true
+	case "format":
+		switch value {
+		case "names", "dirs", "json":
+			QueryFormat = value
+		default:
+			ErrLog.Printf("Unknown format %q\n", value)
+			return false
+		}
+	default:
+		ErrLog.Printf("Unknown option --%s\n", name)
+		return false
+	}
+	return value != ""
+}
+
 func CheckFlags() bool {
 	for _, arg := range os.Args[1:] {
 		if strings.HasPrefix(arg, "-test.") {
 			TestArgs = append(TestArgs, arg)
 			continue
 		}
+		if strings.HasPrefix(arg, "--") {
+			if !CheckLongFlag(arg[2:]) {
+				Usage()
+				return false
+			}
+			continue
+		}
 		if len(arg) > 0 && arg[0] == '-' {
 			for _, flag := range arg[1:] {
 				switch flag {
@@ -601,6 +865,16 @@ func CheckFlags() bool {
 					Makefiles = true
 				case 'M':
 					GenMake = true
+				case 'X':
+					GenScript = true
+				case 'U':
+					UpdateMakefiles = true
+				case 'V':
+					Vendor = true
+				case 'K':
+					WriteLockFile = true
+				case 'k':
+					VerifyLockFile = true
 				case 'f':
 					Force = true
 				case 'g':
@@ -622,6 +896,12 @@ func CheckFlags() bool {
 					Workspace = true
 				case 'R':
 					BuildGOROOT = true
+				case 'u':
+					VCSTargets = true
+				case 'A':
+					Audit = true
+				case 'E':
+					Explain = true
 				default:
 					Usage()
 					return false
@@ -17,8 +17,14 @@
 package main
 
 import (
+	"os"
+	"regexp"
 	"testing"
 	"fmt"
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
 )
 
 type GRTest struct {
@@ -63,6 +69,1335 @@ func TestGetRelative(t *testing.T) {
 	TestWindows = false
 }
 
+func TestMakePkgTemplateCGo(t *testing.T) {
+	data := MakeData{
+		Target:      "e",
+		GBROOT:      "..",
+		GoFiles:     []string{"e3.go"},
+		CGoFiles:    []string{"e1.go", "e2.go"},
+		CObjs:       []string{"e4.o"},
+		CGoCFlags:   []string{"-DE4"},
+		CGoLDFlags:  []string{"-lm"},
+		TestSources: []string{"e_test.go"},
+		BuildDirPkg: "_obj",
+		BuildDirCmd: "bin",
+	}
+	var buf bytes.Buffer
+	if err := MakePkgTemplateExp.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	mf := buf.String()
+	for _, line := range []string{"\te1.go\\\n\te2.go\\\n", "CGO_CFLAGS+= -DE4\n", "CGO_LDFLAGS+= -lm\n", "\te_test.go\\\n"} {
+		if !strings.Contains(mf, line) {
+			t.Error(fmt.Sprintf("generated makefile is missing %q:\n%s", line, mf))
+		}
+	}
+}
+
+func TestGenScript(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	savedCWD, savedPackages, savedListed := CWD, Packages, ListedPkgs
+	savedConcurrent, savedGOARCH, savedBlock := Concurrent, GOARCH, buildBlock
+	defer func() {
+		os.Chdir(wd)
+		CWD, Packages, ListedPkgs = savedCWD, savedPackages, savedListed
+		Concurrent, GOARCH, buildBlock = savedConcurrent, savedGOARCH, savedBlock
+		GenScript, Force = false, false
+	}()
+	if err = os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	CWD, GOARCH = tmp, "amd64"
+	buildBlock = make(chan bool, 4)
+	GenScript, Force, Concurrent = true, true, true
+
+	newPkg := func(dir, target, name string, deps ...*Package) *Package {
+		return &Package{
+			Dir:        dir,
+			Target:     target,
+			Name:       name,
+			IsCmd:      name == "main",
+			Active:     true,
+			NeedsBuild: true,
+			SourceTime: 1,
+			PkgSrc:     map[string][]string{name: []string{dir + ".go"}},
+			ResultPath: filepath.Join("_obj", target+".a"),
+			DepPkgs:    deps,
+			block:      make(chan bool, 1),
+		}
+	}
+	a := newPkg("a", "a", "a")
+	b := newPkg("b", "b", "b")
+	server := newPkg("server", "server", "main", a, b)
+	Packages = map[string]*Package{`"a"`: a, `"b"`: b, `"server"-cmd`: server}
+	ListedPkgs = []*Package{server}
+
+	if err = TryGenScript(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(tmp, ScriptName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(data)
+
+	// each target's commands come together, after those of its deps
+	var last int
+	for _, step := range []string{`building pkg "a"`, " a.go", `building pkg "b"`, " b.go", `building cmd "server"`, " server.go"} {
+		i := strings.Index(script, step)
+		if i < last || strings.Count(script, step) != 1 {
+			t.Fatal(fmt.Sprintf("%q is out of place in the script:\n%s", step, script))
+		}
+		last = i
+	}
+}
+
+func TestLoadTemplate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	savedCWD := CWD
+	defer func() {
+		CWD = savedCWD
+	}()
+	CWD = tmp
+
+	tmpl, err := LoadTemplate("MakePkg", "makepkg.gb", MakePkgTemplateExp)
+	if err != nil || tmpl != MakePkgTemplateExp {
+		t.Error(fmt.Sprintf("LoadTemplate without makepkg.gb -> %v, was expecting the built-in template", err))
+	}
+
+	ioutil.WriteFile(filepath.Join(tmp, "makepkg.gb"), []byte("TARG={{.Target}} # ours\n"), 0644)
+	if tmpl, err = LoadTemplate("MakePkg", "makepkg.gb", MakePkgTemplateExp); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, MakeData{Target: "pkg/db"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "TARG=pkg/db # ours\n" {
+		t.Error(fmt.Sprintf("makepkg.gb -> %q", buf.String()))
+	}
+
+	ioutil.WriteFile(filepath.Join(tmp, "makepkg.gb"), []byte("TARG={{.Target\n"), 0644)
+	if _, err = LoadTemplate("MakePkg", "makepkg.gb", MakePkgTemplateExp); err == nil || !strings.HasPrefix(err.String(), "makepkg.gb: ") {
+		t.Error(fmt.Sprintf("LoadTemplate with a broken makepkg.gb -> %v", err))
+	}
+
+	// one that can't be read isn't quietly replaced by the built-in template
+	os.Remove(filepath.Join(tmp, "makepkg.gb"))
+	os.Mkdir(filepath.Join(tmp, "makepkg.gb"), 0755)
+	if _, err = LoadTemplate("MakePkg", "makepkg.gb", MakePkgTemplateExp); err == nil {
+		t.Error("LoadTemplate ignored a makepkg.gb it couldn't read")
+	}
+}
+
+func TestParseMakefile(t *testing.T) {
+	savedGOOS, savedGOARCH := GOOS, GOARCH
+	defer func() {
+		GOOS, GOARCH = savedGOOS, savedGOARCH
+	}()
+	GOOS, GOARCH = "linux", "amd64"
+
+	mf := `include $(GOROOT)/src/Make.inc
+
+TARG=github.com/someone/thing
+GOFILES=\
+	a.go\
+	b.go\
+
+GOFILES+=c_$(GOOS).go
+OFILES=asm_$(GOARCH).$O # assembly
+CGOFILES=$(GENERATED)
+
+install: extra
+	cp GOFILES=oops.go $(TARG)
+
+include $(GOROOT)/src/Make.pkg
+`
+	info, err := ParseMakefile(strings.NewReader(mf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Targ != "github.com/someone/thing" {
+		t.Error(fmt.Sprintf("TARG: got %q", info.Targ))
+	}
+	if fmt.Sprint(info.GoFiles) != "[a.go b.go c_linux.go]" {
+		t.Error(fmt.Sprintf("GOFILES: got %v", info.GoFiles))
+	}
+	if fmt.Sprint(info.OFiles) != "[asm_amd64.6]" {
+		t.Error(fmt.Sprintf("OFILES: got %v", info.OFiles))
+	}
+	if len(info.CGoFiles) != 0 {
+		t.Error(fmt.Sprintf("CGOFILES: got %v", info.CGoFiles))
+	}
+	if len(info.Includes) != 2 {
+		t.Error(fmt.Sprintf("includes: got %v", info.Includes))
+	}
+}
+
+func TestCheckMakefile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	savedCWD := CWD
+	defer func() {
+		CWD = savedCWD
+	}()
+	CWD = tmp
+
+	pkg := &Package{
+		Dir:         tmp,
+		Target:      "pkg/db",
+		Name:        "db",
+		PkgSrc:      map[string][]string{"db": []string{"db.go"}},
+		HasMakefile: true,
+	}
+	current, err := pkg.MakefileText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmTests := []struct {
+		makefile         string
+		generated, stale bool
+	}{
+		{string(current), true, false},
+		{string(current) + "# edited\n", true, true},
+		{GeneratedMakefileHeader + "\nTARG=old\n", true, true},
+		{"include $(GOROOT)/src/Make.inc\n\nTARG=pkg/db\n", false, false},
+		{"\n" + GeneratedMakefileHeader + "\n", false, false},
+		{"# Makefile written by hand\n", false, false},
+	}
+	for _, cmt := range cmTests {
+		ioutil.WriteFile(filepath.Join(tmp, "Makefile"), []byte(cmt.makefile), 0644)
+		pkg.GeneratedMakefile, pkg.StaleMakefile = false, false
+		pkg.CheckMakefile()
+		if pkg.GeneratedMakefile != cmt.generated || pkg.StaleMakefile != cmt.stale {
+			t.Error(fmt.Sprintf("CheckMakefile(%q) -> generated %v, stale %v, was expecting %v, %v", cmt.makefile, pkg.GeneratedMakefile, pkg.StaleMakefile, cmt.generated, cmt.stale))
+		}
+	}
+}
+
+func TestVendorTargets(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	savedCWD, savedPackages, savedGOPATHS := CWD, Packages, GOPATHS
+	defer func() {
+		os.Chdir(wd)
+		CWD, Packages, GOPATHS = savedCWD, savedPackages, savedGOPATHS
+	}()
+
+	ws, gp := filepath.Join(tmp, "ws"), filepath.Join(tmp, "gopath")
+	for _, dir := range []string{filepath.Join(ws, "vendor", "github.com", "someone", "thing"), filepath.Join(gp, "src", "github.com", "someone", "thing")} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "thing.go"), []byte("package thing\n"), 0644)
+	}
+	if err = os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	CWD, GOPATHS = ws, []string{gp}
+	Packages = make(map[string]*Package)
+
+	ScanDirectory(".", ".")
+	ScanDirectory("", filepath.Join(gp, "src"))
+
+	pkg, ok := Packages[`"github.com/someone/thing"`]
+	if !ok {
+		t.Fatal(fmt.Sprintf("no target named by the import path in %v", Packages))
+	}
+	if !pkg.IsVendored || pkg.IsInGOPATH != "" || pkg.Dir != "vendor/github.com/someone/thing" {
+		t.Error(fmt.Sprintf("\"github.com/someone/thing\" is in %s, was expecting the vendored copy", pkg.Dir))
+	}
+	if len(Packages) != 1 {
+		t.Error(fmt.Sprintf("%d targets, was expecting 1", len(Packages)))
+	}
+}
+
+func TestRemoteRepo(t *testing.T) {
+	rrTests := [][3]string{
+		{`github.com/skelterjohn/go-gb/gb`, `git`, `github.com/skelterjohn/go-gb`},
+		{`"go-glue.googlecode.com/hg/rlglue"`, `hg`, `go-glue.googlecode.com/hg`},
+		{`bitbucket.org/someone/thing`, `hg`, `bitbucket.org/someone/thing`},
+		{`launchpad.net/gocheck`, `bzr`, `launchpad.net/gocheck`},
+	}
+	for _, rrt := range rrTests {
+		vcs, root, ok := RemoteRepo(rrt[0])
+		if !ok || vcs != rrt[1] || root != rrt[2] {
+			t.Error(fmt.Sprintf("RemoteRepo(%q) -> %q, %q, %v, was expecting %q, %q", rrt[0], vcs, root, ok, rrt[1], rrt[2]))
+		}
+	}
+	if _, _, ok := RemoteRepo(`fmt`); ok {
+		t.Error("RemoteRepo(\"fmt\") should not match")
+	}
+}
+
+func TestMirrorFetch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	savedMirrorDir, savedUpdate := MirrorDir, GoInstallUpdate
+	defer func() {
+		os.Chdir(wd)
+		MirrorDir, GoInstallUpdate = savedMirrorDir, savedUpdate
+	}()
+
+	MirrorDir = filepath.Join(tmp, "mirror")
+	src := filepath.Join(MirrorDir, "github.com", "someone", "thing")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "thing.go"), []byte("package thing\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "sub.go"), []byte("package sub\n"), 0644)
+	if err = os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	GoInstallUpdate = true
+
+	dir, err := MirrorFetch("github.com/someone/thing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != filepath.Join(MirrorWorkDir, "github.com", "someone", "thing") {
+		t.Error(fmt.Sprintf("MirrorFetch -> %s", dir))
+	}
+	// with -G the root is fetched again in the next run, but not again for
+	// another package in the same repository
+	marker := filepath.Join(dir, "built")
+	ioutil.WriteFile(marker, nil, 0644)
+	if dir, err = MirrorFetch("github.com/someone/thing/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if !isDir(dir) {
+		t.Error(fmt.Sprintf("%s wasn't checked out", dir))
+	}
+	if _, err = os.Stat(marker); err != nil {
+		t.Error("the repository was fetched a second time")
+	}
+}
+
+func TestScanGOPATHDeps(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	savedPackages, savedGOPATHS, savedSrcRoots := Packages, GOPATHS, GOPATH_SRCROOTS
+	savedGOOS, savedGOARCH, savedClean := GOOS, GOARCH, Clean
+	defer func() {
+		Packages, GOPATHS, GOPATH_SRCROOTS = savedPackages, savedGOPATHS, savedSrcRoots
+		GOOS, GOARCH, Clean = savedGOOS, savedGOARCH, savedClean
+	}()
+	GOOS, GOARCH = "linux", "amd64"
+
+	gp := filepath.Join(tmp, "gopath")
+	GOPATHS, GOPATH_SRCROOTS = []string{gp}, []string{filepath.Join(gp, "src")}
+	for _, name := range []string{"used", "unused"} {
+		dir := filepath.Join(gp, "src", "example.com", name)
+		os.MkdirAll(dir, 0755)
+		src := filepath.Join(dir, name+".go")
+		ioutil.WriteFile(src, []byte("package "+name+"\n"), 0644)
+		os.Chtimes(src, 2000e9, 2000e9)
+	}
+	archive := filepath.Join(gp, "pkg", "linux_amd64", "example.com", "used.a")
+	archiveDir, _ := filepath.Split(archive)
+	os.MkdirAll(archiveDir, 0755)
+	ioutil.WriteFile(archive, nil, 0644)
+
+	server := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, Deps: []string{`"example.com/used"`}}
+	Packages = map[string]*Package{`"server"-cmd`: server}
+	if err = ScanGOPATHDeps(); err != nil {
+		t.Fatal(err)
+	}
+	used, ok := Packages[`"example.com/used"`]
+	if !ok || used.IsInGOPATH != gp || len(Packages) != 2 {
+		t.Fatal(fmt.Sprintf("ScanGOPATHDeps found %v, was expecting only \"example.com/used\"", Packages))
+	}
+
+	// rebuilt when the source is newer than the archive, and not otherwise
+	for _, stale := range []bool{true, false} {
+		mtime := int64(3000e9)
+		if stale {
+			mtime = 1000e9
+		}
+		os.Chtimes(archive, mtime, mtime)
+		used.NeedsBuild = false
+		used.Stat()
+		used.CheckStatus()
+		if used.NeedsBuild != stale {
+			t.Error(fmt.Sprintf("with the archive at %d and the source at %d, NeedsBuild = %v", used.BinTime, used.SourceTime, used.NeedsBuild))
+		}
+	}
+
+	// -c doesn't touch the archive
+	used.Active, Clean = true, true
+	used.Clean()
+	if _, err = os.Stat(archive); err != nil {
+		t.Error("cleaning removed the $GOPATH archive")
+	}
+}
+
+func TestRemoteURL(t *testing.T) {
+	saved := goinstallables
+	defer func() {
+		goinstallables = saved
+	}()
+	host := &RemoteHost{regexp.MustCompile(`^(code\.example\.com/([a-z]+))(/.*)?$`), "git", "ssh://git@code.example.com/{2}.git"}
+	goinstallables = append([]*RemoteHost{host}, goinstallables...)
+
+	vcs, root, url, ok := RemoteURL(`"code.example.com/tools/sub"`)
+	if !ok || vcs != "git" || root != "code.example.com/tools" || url != "ssh://git@code.example.com/tools.git" {
+		t.Error(fmt.Sprintf("RemoteURL -> %q, %q, %q, %v", vcs, root, url, ok))
+	}
+	if !IsGoInstallable(`"code.example.com/tools/sub"`) {
+		t.Error("code.example.com/tools/sub should be remote")
+	}
+	if _, _, _, ok := RemoteURL(`github.com/someone/thing`); ok {
+		t.Error("goinstall fetches from github itself")
+	}
+}
+
+func TestLoadRemoteHosts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	savedCWD, saved := CWD, goinstallables
+	defer func() {
+		CWD, goinstallables = savedCWD, saved
+	}()
+	CWD = tmp
+
+	hosts := "# our own server\n^(code\\.example\\.com/[a-z]+)(/.*)?$ hg https://{root}\n"
+	ioutil.WriteFile(filepath.Join(tmp, RemoteHostsFile), []byte(hosts), 0644)
+	if err = LoadRemoteHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if vcs, _, url, ok := RemoteURL("code.example.com/tools"); !ok || vcs != "hg" || url != "https://code.example.com/tools" {
+		t.Error(fmt.Sprintf("RemoteURL -> %q, %q, %v", vcs, url, ok))
+	}
+
+	goinstallables = saved
+	ioutil.WriteFile(filepath.Join(tmp, RemoteHostsFile), []byte(hosts+"^(other\\.example\\.com/[a-z]+) cvs https://{root}\n"), 0644)
+	if err = LoadRemoteHosts(); err == nil || !strings.HasPrefix(err.String(), RemoteHostsFile+":3: unknown vcs") {
+		t.Error(fmt.Sprintf("LoadRemoteHosts with a cvs host -> %v", err))
+	}
+}
+
+func TestOverride(t *testing.T) {
+	savedPackages, savedOverrides := Packages, Overrides
+	defer func() {
+		Packages, Overrides = savedPackages, savedOverrides
+	}()
+	patched := &Package{Dir: "third_party/thing", Target: "third_party/thing", Active: true}
+	vendored := &Package{Dir: "vendor/github.com/someone/thing", Target: "github.com/someone/thing", Active: true, IsVendored: true}
+	Packages = map[string]*Package{
+		`"third_party/thing"`:        patched,
+		`"github.com/someone/thing"`: vendored,
+	}
+	Overrides = make(map[string]*Package)
+
+	if err := Override("github.com/someone/thing", "third_party/thing/"); err != nil {
+		t.Fatal(err)
+	}
+	if pkg, ok := LookupImport(`"github.com/someone/thing"`); !ok || pkg != patched {
+		t.Error("the override should stand in for github.com/someone/thing")
+	}
+	if vendored.Active {
+		t.Error("the vendored copy should no longer be built")
+	}
+	if len(patched.Aliases) != 1 || patched.Aliases[0] != "github.com/someone/thing" {
+		t.Error(fmt.Sprintf("Aliases = %v", patched.Aliases))
+	}
+	if err := Override("github.com/someone/other", "nowhere"); err == nil {
+		t.Error("overriding with a directory that has no package should fail")
+	}
+}
+
+func TestRemoteImportPath(t *testing.T) {
+	ripTests := [][2]string{
+		{"https://github.com/team/proj.git", "github.com/team/proj"},
+		{"git@github.com:team/proj.git\n", "github.com/team/proj"},
+		{"ssh://hg@bitbucket.org/team/proj/", "bitbucket.org/team/proj"},
+		{"https://proj.googlecode.com/hg/", "proj.googlecode.com/hg"},
+	}
+	for _, ript := range ripTests {
+		if ipath, ok := RemoteImportPath(ript[0]); !ok || ipath != ript[1] {
+			t.Error(fmt.Sprintf("RemoteImportPath(%q) -> %q, %v, was expecting %q", ript[0], ipath, ok, ript[1]))
+		}
+	}
+	if _, ok := RemoteImportPath("/home/someone/proj"); ok {
+		t.Error("a local clone url has no import path")
+	}
+}
+
+func TestInstallGOPATH(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	savedCWD, savedOSWD, savedGOPATHS, savedSingle, savedInstall := CWD, OSWD, GOPATHS, GOPATH_SINGLE, GOPATH_INSTALL
+	savedGOOS, savedGOARCH := GOOS, GOARCH
+	defer func() {
+		os.Chdir(wd)
+		CWD, OSWD, GOPATHS, GOPATH_SINGLE, GOPATH_INSTALL = savedCWD, savedOSWD, savedGOPATHS, savedSingle, savedInstall
+		GOOS, GOARCH = savedGOOS, savedGOARCH
+	}()
+	GOOS, GOARCH = "linux", "amd64"
+
+	gp1, gp2, ws := filepath.Join(tmp, "gp1"), filepath.Join(tmp, "gp2"), filepath.Join(tmp, "ws")
+	os.MkdirAll(filepath.Join(ws, "db"), 0755)
+	ioutil.WriteFile(filepath.Join(ws, "db", "db.go"), []byte("package db\n"), 0644)
+	CWD, OSWD = ws, ws
+	GOPATHS, GOPATH_SINGLE = []string{gp1, gp2}, gp1
+
+	if gp, err := InstallGOPATH(""); err != nil || gp != gp1 {
+		t.Error(fmt.Sprintf("InstallGOPATH by default -> %s, %v", gp, err))
+	}
+	// no newline at the end
+	ioutil.WriteFile(filepath.Join(ws, InstallGOPATHFile), []byte("../gp2"), 0644)
+	if gp, err := InstallGOPATH(""); err != nil || gp != gp2 {
+		t.Error(fmt.Sprintf("InstallGOPATH with %s -> %s, %v", InstallGOPATHFile, gp, err))
+	}
+	if gp, err := InstallGOPATH(gp1); err != nil || gp != gp1 {
+		t.Error(fmt.Sprintf("InstallGOPATH with $GB_INSTALL_GOPATH -> %s, %v", gp, err))
+	}
+	if _, err := InstallGOPATH(filepath.Join(tmp, "elsewhere")); err == nil {
+		t.Error("InstallGOPATH accepted a directory that isn't in $GOPATH")
+	}
+
+	// -N and -s go by the InstallPath, and the makefiles by TARGDIR
+	if err = os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	GOPATH_INSTALL = gp2
+	pkg, err := NewPackage("db", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(gp2, "pkg", "linux_amd64")
+	if pkg.InstallPath != filepath.Join(want, pkg.Target+".a") {
+		t.Error(fmt.Sprintf("InstallPath = %s, was expecting it in %s", pkg.InstallPath, want))
+	}
+	if data := pkg.MakeData(); data.InstallDir != want {
+		t.Error(fmt.Sprintf("the makefile installs into %s, was expecting %s", data.InstallDir, want))
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	saved := Policy
+	defer func() {
+		Policy = saved
+	}()
+	Policy = []*PolicyRule{
+		&PolicyRule{true, "github.com/team", 1},
+		&PolicyRule{false, "github.com/team/legacy", 2},
+	}
+	policyTests := map[string]bool{
+		`"github.com/team/proj"`:         true,
+		`"github.com/team/legacy/sub"`:   false,
+		`"github.com/teammate/proj"`:     false,
+		`"bitbucket.org/someone/thing"`:  false,
+	}
+	for dep, want := range policyTests {
+		if ok, why := CheckPolicy(dep); ok != want {
+			t.Error(fmt.Sprintf("CheckPolicy(%s) -> %v %q, was expecting %v", dep, ok, why, want))
+		}
+	}
+
+	Policy = []*PolicyRule{&PolicyRule{false, "*", 1}, &PolicyRule{true, "launchpad.net/gocheck", 2}}
+	if ok, _ := CheckPolicy(`"launchpad.net/gocheck"`); !ok {
+		t.Error("the longer allow prefix should win over *")
+	}
+	if ok, _ := CheckPolicy(`"github.com/team/proj"`); ok {
+		t.Error("* should deny everything else")
+	}
+
+	// an overridden import is classified by the package it points at
+	savedPackages, savedOverrides := Packages, Overrides
+	defer func() {
+		Packages, Overrides = savedPackages, savedOverrides
+	}()
+	patched := &Package{Dir: "patched/thing", Target: "patched/thing"}
+	vendored := &Package{Dir: "vendor/github.com/someone/other", Target: "github.com/someone/other", IsVendored: true}
+	Packages = map[string]*Package{`"patched/thing"`: patched, `"github.com/someone/other"`: vendored}
+	Overrides = map[string]*Package{`"github.com/someone/thing"`: patched, `"github.com/someone/fork"`: vendored}
+	if IsExternalImport(`"github.com/someone/thing"`) {
+		t.Error("an import overridden by a workspace target counts as external")
+	}
+	if !IsExternalImport(`"github.com/someone/fork"`) {
+		t.Error("an import overridden by a vendored package doesn't count as external")
+	}
+}
+
+func TestCheckLayers(t *testing.T) {
+	saved := Layers
+	defer func() {
+		Layers = saved
+	}()
+	Layers = []*LayerRule{
+		&LayerRule{ParseLayerPattern("core"), ParseLayerPattern("ui/"), 1},
+		&LayerRule{ParseLayerPattern("*"), ParseLayerPattern("cmd:*"), 2},
+	}
+	core := &Package{Dir: "core/db", Target: "core/db"}
+	ui := &Package{Dir: "ui/widgets", Target: "ui/widgets"}
+	uicmd := &Package{Dir: "ui/main", Target: "main", IsCmd: true}
+	coreish := &Package{Dir: "coreutils", Target: "coreutils"}
+
+	if ok, _ := CheckLayers(core, ui); ok {
+		t.Error("core may not import ui")
+	}
+	if ok, _ := CheckLayers(ui, core); !ok {
+		t.Error("ui may import core")
+	}
+	if ok, _ := CheckLayers(ui, uicmd); ok {
+		t.Error("cmds may not be imported")
+	}
+	if ok, _ := CheckLayers(coreish, ui); !ok {
+		t.Error("coreutils is not under core")
+	}
+}
+
+func TestLockRoundTrip(t *testing.T) {
+	entries := []*LockEntry{
+		&LockEntry{"github.com/someone/thing", "git", "0123abcd", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		&LockEntry{"go-glue.googlecode.com/hg/rlglue", "hg", "-", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+	}
+	var buf bytes.Buffer
+	if err := WriteLock(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ParseLock(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(entries) {
+		t.Fatal(fmt.Sprintf("read %d entries, wrote %d", len(read), len(entries)))
+	}
+	for i, e := range entries {
+		if *read[i] != *e {
+			t.Error(fmt.Sprintf("entry %d: read %v, wrote %v", i, *read[i], *e))
+		}
+	}
+}
+
+func TestVerifyLock(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	savedPackages, savedListed, savedHosts := Packages, ListedPkgs, goinstallables
+	savedSingle, savedSrcRoots, savedVerify := GOPATH_SINGLE, GOPATH_SRCROOTS, VerifyLockFile
+	defer func() {
+		os.Chdir(wd)
+		Packages, ListedPkgs, goinstallables = savedPackages, savedListed, savedHosts
+		GOPATH_SINGLE, GOPATH_SRCROOTS, VerifyLockFile = savedSingle, savedSrcRoots, savedVerify
+		lockEntries, lockErr = nil, nil
+	}()
+
+	// a repository to fetch from over file://
+	remote := filepath.Join(tmp, "remote")
+	os.MkdirAll(remote, 0755)
+	ioutil.WriteFile(filepath.Join(remote, "thing.go"), []byte("package thing\n"), 0644)
+	for _, argv := range [][]string{
+		[]string{"git", "init", "-q"},
+		[]string{"git", "add", "thing.go"},
+		[]string{"git", "-c", "user.name=gb", "-c", "user.email=gb@example.com", "commit", "-q", "-m", "thing"},
+	} {
+		if _, err = RunExternalOutput(remote, argv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rev, err := gitRev(remote, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gp := filepath.Join(tmp, "gopath")
+	GOPATH_SINGLE, GOPATH_SRCROOTS = gp, []string{filepath.Join(gp, "src")}
+	goinstallables = []*RemoteHost{&RemoteHost{regexp.MustCompile(`^(code\.example\.com/[a-z]+)(/.*)?$`), "git", "file://" + remote}}
+	if err = FetchRemote("code.example.com/thing"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := filepath.Join(tmp, "ws")
+	os.MkdirAll(ws, 0755)
+	if err = os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	server := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, Deps: []string{`"code.example.com/thing"`}}
+	Packages = map[string]*Package{`"server"-cmd`: server}
+	ListedPkgs = []*Package{server}
+
+	entry, err := LockSource("code.example.com/thing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.VCS != "git" || entry.Revision != rev {
+		t.Error(fmt.Sprintf("LockSource -> %v, was expecting git at %s", *entry, rev))
+	}
+
+	VerifyLockFile = true
+	for _, c := range []struct {
+		revision, hash string
+		ok             bool
+	}{
+		{rev, entry.Hash, true},
+		{"-", entry.Hash, true},
+		{rev, "da39a3ee5e6b4b0d3255bfef95601890afd80709", false},
+		{"0123abcd", entry.Hash, false},
+	} {
+		lock := fmt.Sprintf("code.example.com/thing git %s %s\n", c.revision, c.hash)
+		ioutil.WriteFile(LockFile, []byte(lock), 0644)
+		if err = TryVerifyLock(); (err == nil) != c.ok {
+			t.Error(fmt.Sprintf("TryVerifyLock with %q -> %v", lock, err))
+		}
+	}
+
+	ioutil.WriteFile(LockFile, []byte("code.example.com/thing git\n"), 0644)
+	lockEntries = nil
+	if _, err = LockedEntry("code.example.com/thing"); err == nil {
+		t.Error("LockedEntry accepted a broken lock file")
+	}
+}
+
+func queryNames(t *testing.T, expr string) string {
+	set, err := EvalQuery(expr)
+	if err != nil {
+		t.Error(fmt.Sprintf("EvalQuery(%q): %v", expr, err))
+		return ""
+	}
+	var names []string
+	for _, pkg := range set.Sorted() {
+		names = append(names, pkg.Target)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestQuery(t *testing.T) {
+	saved := Packages
+	defer func() {
+		Packages = saved
+	}()
+	fmtpkg := &Package{Dir: "/go/src/pkg/fmt", Target: "fmt", IsInGOROOT: true}
+	legacy := &Package{Dir: "pkg/legacy", Target: "pkg/legacy", DepPkgs: []*Package{fmtpkg}}
+	auth := &Package{Dir: "pkg/auth", Target: "pkg/auth", DepPkgs: []*Package{fmtpkg}, NeedsBuild: true}
+	server := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, DepPkgs: []*Package{auth}}
+	tool := &Package{Dir: "cmd/tool", Target: "tool", IsCmd: true, DepPkgs: []*Package{auth, legacy}}
+	Packages = map[string]*Package{
+		`"fmt"`:        fmtpkg,
+		`"pkg/legacy"`: legacy,
+		`"pkg/auth"`:   auth,
+		`"server"-cmd`: server,
+		`"tool"-cmd`:   tool,
+	}
+
+	queryTests := [][2]string{
+		{"deps(tool)", "fmt pkg/auth pkg/legacy"},
+		{"rdeps(pkg/auth)", "server tool"},
+		{"kind(cmd, rdeps(pkg/auth) - rdeps(pkg/legacy))", "server"},
+		{"loc(workspace, deps(cmd/...))", "pkg/auth pkg/legacy"},
+		{"stale(*)", "pkg/auth"},
+		{"kind(pkg, *) & (rdeps(fmt) | fmt)", "fmt pkg/auth pkg/legacy"},
+	}
+	for _, qt := range queryTests {
+		if got := queryNames(t, qt[0]); got != qt[1] {
+			t.Error(fmt.Sprintf("%s -> %q, was expecting %q", qt[0], got, qt[1]))
+		}
+	}
+	if _, err := EvalQuery("deps(nothing)"); err == nil {
+		t.Error("an unknown target should be an error")
+	}
+}
+
+func TestQueryTestDeps(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	savedPackages, savedCWD, savedGOOS, savedGOARCH := Packages, CWD, GOOS, GOARCH
+	savedTest, savedQuery, savedReporting, savedScanTestDeps := Test, Query, Reporting, ScanTestDeps
+	defer func() {
+		os.Chdir(wd)
+		Packages, CWD, GOOS, GOARCH = savedPackages, savedCWD, savedGOOS, savedGOARCH
+		Test, Query, Reporting, ScanTestDeps = savedTest, savedQuery, savedReporting, savedScanTestDeps
+	}()
+	GOOS, GOARCH = "linux", "amd64"
+
+	for name, src := range map[string]string{
+		"db/db.go":           "package db\n",
+		"db/db_test.go":      "package db\n\nimport \"fixture\"\n",
+		"fixture/fixture.go": "package fixture\n",
+	} {
+		dir, _ := filepath.Split(filepath.Join(tmp, name))
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(tmp, name), []byte(src), 0644)
+	}
+	if err = os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	CWD = tmp
+
+	// gb "--query=testdeps(db)", without -t
+	Test, Reporting = false, false
+	if !CheckLongFlag("query=testdeps(db)") {
+		t.Fatal("--query not accepted")
+	}
+	SetScanTestDeps()
+	Packages = make(map[string]*Package)
+	for _, dir := range []string{"db", "fixture"} {
+		pkg, err := NewPackage(dir, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Packages["\""+pkg.Target+"\""] = pkg
+	}
+	for _, pkg := range Packages {
+		pkg.ResolveDeps()
+	}
+	if got := queryNames(t, "testdeps(db)"); got != "fixture" {
+		t.Error(fmt.Sprintf("testdeps(db) without -t -> %q, was expecting \"fixture\"", got))
+	}
+}
+
+func TestExplainBuild(t *testing.T) {
+	dep := &Package{Target: "pkg/dep", NeedsBuild: true}
+	pkg := &Package{Target: "pkg/top", ResultPath: "_obj/pkg/top.a", BinTime: 100, DepPkgs: []*Package{dep}}
+	reasons := pkg.ExplainBuild()
+	if len(reasons) != 1 || !strings.Contains(reasons[0], `"pkg/dep" will be rebuilt`) {
+		t.Error(fmt.Sprintf("ExplainBuild -> %q", reasons))
+	}
+
+	pkg.BinTime = 0
+	reasons = pkg.ExplainBuild()
+	if len(reasons) != 1 || reasons[0] != "_obj/pkg/top.a is missing" {
+		t.Error(fmt.Sprintf("ExplainBuild -> %q", reasons))
+	}
+}
+
+func TestPaths(t *testing.T) {
+	savedPackages, savedTest := Packages, Test
+	defer func() {
+		Packages, Test = savedPackages, savedTest
+	}()
+	sqlite := &Package{Dir: "pkg/sqlite", Target: "pkg/sqlite"}
+	db := &Package{Dir: "pkg/db", Target: "pkg/db", Deps: []string{`"pkg/sqlite"`},
+		SrcDeps: map[string][]string{"db.go": []string{`"pkg/sqlite"`}}, DepPkgs: []*Package{sqlite}}
+	cache := &Package{Dir: "pkg/cache", Target: "pkg/cache", Deps: []string{`"pkg/db"`},
+		SrcDeps: map[string][]string{"cache.go": []string{`"pkg/db"`}}, DepPkgs: []*Package{db}}
+	server := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, Deps: []string{`"pkg/cache"`, `"pkg/db"`},
+		SrcDeps: map[string][]string{"main.go": []string{`"pkg/cache"`}, "store.go": []string{`"pkg/db"`}},
+		DepPkgs: []*Package{cache, db}}
+	Packages = map[string]*Package{
+		`"pkg/sqlite"`: sqlite,
+		`"pkg/db"`:     db,
+		`"pkg/cache"`:  cache,
+		`"server"-cmd`: server,
+	}
+	Test = false
+
+	from := TargetSet{server: true}
+	to := TargetSet{sqlite: true}
+	path, found := ShortestPath(from, to)
+	if !found || len(path) != 2 || path[0].To != db || path[1].To != sqlite {
+		t.Fatal(fmt.Sprintf("ShortestPath -> %v", path))
+	}
+	if s := path[0].String(); s != `imports "pkg/db" in cmd/server/store.go` {
+		t.Error(fmt.Sprintf("edge -> %q", s))
+	}
+	if paths := AllPathsBetween(from, to); len(paths) != 2 {
+		t.Error(fmt.Sprintf("AllPathsBetween -> %v", paths))
+	}
+	if _, found := ShortestPath(to, from); found {
+		t.Error("sqlite doesn't import server")
+	}
+	// a target on both sides is reached without any imports
+	from, to = TargetSet{server: true, db: true}, TargetSet{db: true}
+	if path, found := ShortestPath(from, to); !found || len(path) != 0 {
+		t.Error(fmt.Sprintf("ShortestPath with overlapping ends -> %v %v", path, found))
+	}
+
+	ends, err := SplitPathQuery("kind(cmd, rdeps(pkg/sqlite)),loc(workspace, pkg/sqlite)")
+	if err != nil || len(ends) != 2 {
+		t.Fatal(fmt.Sprintf("SplitPathQuery -> %q, %v", ends, err))
+	}
+	if from, err = EvalQuery(ends[0]); err != nil || len(from) != 1 || !from[server] {
+		t.Error(fmt.Sprintf("FROM %q -> %v, %v", ends[0], from.Sorted(), err))
+	}
+	if to, err = EvalQuery(ends[1]); err != nil || len(to) != 1 || !to[sqlite] {
+		t.Error(fmt.Sprintf("TO %q -> %v, %v", ends[1], to.Sorted(), err))
+	}
+	if _, err = SplitPathQuery("kind(cmd, server)"); err == nil {
+		t.Error("SplitPathQuery found a comma inside parentheses")
+	}
+}
+
+func TestSingleUseImports(t *testing.T) {
+	pkg := &Package{Name: "db", Target: "pkg/db",
+		PkgSrc:    map[string][]string{"db": []string{"db.go", "export.go"}},
+		PkgCGoSrc: map[string][]string{"db": []string{"sqlite.go"}},
+		SrcDeps: map[string][]string{
+			"db.go":     []string{`"os"`, `"fmt"`},
+			"export.go": []string{`"fmt"`, `"encoding/csv"`},
+			"sqlite.go": []string{`"C"`, `"fmt"`},
+			"doc.go":    []string{`"strings"`},
+		}}
+	single := pkg.SingleUseImports()
+	if len(single) != 2 || single[`"os"`] != "db.go" || single[`"encoding/csv"`] != "export.go" {
+		t.Error(fmt.Sprintf("SingleUseImports -> %v", single))
+	}
+	if deps := pkg.BuiltSrcDeps()["sqlite.go"]; len(deps) != 1 || deps[0] != `"fmt"` {
+		t.Error(fmt.Sprintf("sqlite.go imports %v, was expecting only \"fmt\"", deps))
+	}
+}
+
+func TestImportCycles(t *testing.T) {
+	savedPackages, savedTest := Packages, Test
+	defer func() {
+		Packages, Test = savedPackages, savedTest
+	}()
+	a := &Package{Dir: "a", Target: "a"}
+	b := &Package{Dir: "b", Target: "b"}
+	c := &Package{Dir: "c", Target: "c"}
+	d := &Package{Dir: "d", Target: "d"}
+	e := &Package{Dir: "e", Target: "e"}
+	a.DepPkgs = []*Package{b}
+	b.DepPkgs = []*Package{a, c}
+	c.DepPkgs = []*Package{d}
+	d.DepPkgs = []*Package{e}
+	e.TestDepPkgs = []*Package{c, e}
+	Packages = map[string]*Package{`"a"`: a, `"b"`: b, `"c"`: c, `"d"`: d, `"e"`: e}
+
+	Test = false
+	cycles := ImportCycles()
+	if len(cycles) != 1 || len(cycles[0]) != 2 {
+		t.Fatal(fmt.Sprintf("ImportCycles -> %v", cycles))
+	}
+	cycle, others := CycleThrough(cycles[0])
+	if len(cycle) != 2 || cycle[0].From != a || cycle[1].From != b || len(others) != 0 {
+		t.Error(fmt.Sprintf("CycleThrough -> %v, %v", cycle, others))
+	}
+
+	// with the tests, e's test imports close a second cycle, but its
+	// import of e itself doesn't count
+	Test = true
+	if cycles := ImportCycles(); len(cycles) != 2 {
+		t.Error(fmt.Sprintf("ImportCycles with tests -> %v", cycles))
+	}
+}
+
+func TestCycleEdgeLines(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	savedPackages, savedTest := Packages, Test
+	defer func() {
+		Packages, Test = savedPackages, savedTest
+	}()
+
+	os.MkdirAll(filepath.Join(tmp, "a"), 0755)
+	os.MkdirAll(filepath.Join(tmp, "b"), 0755)
+	ioutil.WriteFile(filepath.Join(tmp, "a", "a.go"), []byte("package a\n\nimport (\n\t\"fmt\"\n\t\"b\"\n)\n"), 0644)
+	ioutil.WriteFile(filepath.Join(tmp, "b", "b_test.go"), []byte("package b\n\nimport \"a\"\n"), 0644)
+	a := &Package{Dir: filepath.Join(tmp, "a"), Target: "a", Deps: []string{`"fmt"`, `"b"`},
+		SrcDeps: map[string][]string{"a.go": []string{`"fmt"`, `"b"`}}}
+	b := &Package{Dir: filepath.Join(tmp, "b"), Target: "b", TestDeps: []string{`"a"`},
+		TestSrcDeps: map[string][]string{"b_test.go": []string{`"a"`}}}
+	a.DepPkgs = []*Package{b}
+	b.TestDepPkgs = []*Package{a}
+	Packages = map[string]*Package{`"a"`: a, `"b"`: b}
+
+	// only b's test closes the cycle
+	Test = true
+	cycles := ImportCycles()
+	if len(cycles) != 1 {
+		t.Fatal(fmt.Sprintf("ImportCycles -> %v", cycles))
+	}
+	cycle, _ := CycleThrough(cycles[0])
+	want := []string{
+		fmt.Sprintf(`imports "b" in %s:5`, filepath.Join(tmp, "a", "a.go")),
+		fmt.Sprintf(`imports "a" in %s:3 (test)`, filepath.Join(tmp, "b", "b_test.go")),
+	}
+	if len(cycle) != len(want) {
+		t.Fatal(fmt.Sprintf("CycleThrough -> %v", cycle))
+	}
+	for i, edge := range cycle {
+		if got := edge.String(); got != want[i] {
+			t.Error(fmt.Sprintf("edge %d -> %q, was expecting %q", i, got, want[i]))
+		}
+	}
+}
+
+func TestImportSuggestions(t *testing.T) {
+	saved := Packages
+	defer func() {
+		Packages = saved
+	}()
+	Packages = map[string]*Package{
+		`"pkg/util"`:  &Package{Dir: "pkg/util", Target: "pkg/util"},
+		`"db"`:        &Package{Dir: "pkg/database", Target: "db"},
+		`"net/retry"`: &Package{Dir: "net/retry", Target: "net/retry"},
+	}
+
+	if d := EditDistance("kitten", "sitting"); d != 3 {
+		t.Error(fmt.Sprintf("EditDistance(kitten, sitting) -> %d", d))
+	}
+
+	sugTests := map[string]string{
+		`"pkg/utl"`:      `"pkg/util"`,
+		`"pkg/database"`: `"db", the target in pkg/database`,
+		`"lib/retry"`:    `"net/retry"`,
+	}
+	for dep, want := range sugTests {
+		sugs := ImportSuggestions(dep)
+		if len(sugs) == 0 || sugs[0] != want {
+			t.Error(fmt.Sprintf("ImportSuggestions(%s) -> %q, was expecting %q first", dep, sugs, want))
+		}
+	}
+	if sugs := ImportSuggestions(`"github.com/someone/thing"`); len(sugs) != 0 {
+		t.Error(fmt.Sprintf("ImportSuggestions -> %q, was expecting none", sugs))
+	}
+}
+
+func TestUnreachableTargets(t *testing.T) {
+	saved := Packages
+	defer func() {
+		Packages = saved
+	}()
+	fmtpkg := &Package{Dir: "/go/src/pkg/fmt", Target: "fmt", IsInGOROOT: true}
+	used := &Package{Dir: "pkg/used", Target: "pkg/used", DepPkgs: []*Package{fmtpkg}}
+	fixture := &Package{Dir: "pkg/fixture", Target: "pkg/fixture"}
+	dead := &Package{Dir: "pkg/dead", Target: "pkg/dead", DepPkgs: []*Package{used}, TestDepPkgs: []*Package{fixture}}
+	server := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, DepPkgs: []*Package{used}}
+	Packages = map[string]*Package{
+		`"fmt"`:         fmtpkg,
+		`"pkg/used"`:    used,
+		`"pkg/fixture"`: fixture,
+		`"pkg/dead"`:    dead,
+		`"server"-cmd`:  server,
+	}
+
+	if got := UnreachableTargets(false); len(got) != 2 || !got[dead] || !got[fixture] {
+		t.Error(fmt.Sprintf("UnreachableTargets(false) -> %v", got.Sorted()))
+	}
+	if got := UnreachableTargets(true); len(got) != 1 || !got[dead] {
+		t.Error(fmt.Sprintf("UnreachableTargets(true) -> %v", got.Sorted()))
+	}
+}
+
+func TestUnreachableBuildsNothing(t *testing.T) {
+	savedBuild, savedTest, savedInstall := Build, Test, Install
+	savedUnreachable, savedReporting := Unreachable, Reporting
+	defer func() {
+		Build, Test, Install = savedBuild, savedTest, savedInstall
+		Unreachable, Reporting = savedUnreachable, savedReporting
+	}()
+
+	// gb --unreachable -t
+	Build, Test, Install, Unreachable, Reporting = false, true, false, false, false
+	if !CheckLongFlag("unreachable") {
+		t.Fatal("--unreachable not accepted")
+	}
+	SetBuild()
+	if Build {
+		t.Error("--unreachable -t builds the targets")
+	}
+}
+
+func TestDiffGraphs(t *testing.T) {
+	oldDB := &Package{Dir: "pkg/db", Target: "pkg/db", Deps: []string{`"fmt"`}}
+	oldUtil := &Package{Dir: "pkg/util", Target: "pkg/util"}
+	oldServer := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, Deps: []string{`"pkg/db"`, `"pkg/util"`}}
+	// overrides.gb points github.com/someone/thing at third_party/thing
+	thing := &Package{Dir: "third_party/thing", Target: "third_party/thing", Aliases: []string{"github.com/someone/thing"}}
+	before := GraphSnapshot{`"pkg/db"`: oldDB, `"pkg/util"`: oldUtil, `"server"-cmd`: oldServer, `"third_party/thing"`: thing}
+
+	newDB := &Package{Dir: "pkg/db", Target: "db", Deps: []string{`"fmt"`, `"github.com/someone/sqlite"`}}
+	newCache := &Package{Dir: "pkg/cache", Target: "pkg/cache", Deps: []string{`"db"`, `"github.com/someone/thing"`}}
+	newServer := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, Deps: []string{`"db"`, `"pkg/cache"`}}
+	after := GraphSnapshot{`"db"`: newDB, `"pkg/cache"`: newCache, `"server"-cmd`: newServer, `"third_party/thing"`: thing}
+
+	want := []string{
+		`+ target "pkg/cache" (in pkg/cache)`,
+		`- target "pkg/util" (in pkg/util)`,
+		`~ target "pkg/db" renamed "db" (in pkg/db)`,
+		`+ "pkg/cache" imports "db"`,
+		`+ "pkg/cache" imports "third_party/thing"`,
+		`+ "server (cmd)" imports "pkg/cache"`,
+		`- "server (cmd)" imports "pkg/util"`,
+		`+ external import "github.com/someone/sqlite"`,
+	}
+	got := DiffGraphs(before, after)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Error(fmt.Sprintf("DiffGraphs ->\n%s\nwas expecting\n%s", strings.Join(got, "\n"), strings.Join(want, "\n")))
+	}
+}
+
+func TestAffectedTargets(t *testing.T) {
+	savedPackages, savedTest := Packages, Test
+	defer func() {
+		Packages, Test = savedPackages, savedTest
+	}()
+	db := &Package{Dir: "pkg/db", Target: "pkg/db"}
+	cache := &Package{Dir: "pkg/cache", Target: "pkg/cache", DepPkgs: []*Package{db}}
+	other := &Package{Dir: "pkg/other", Target: "pkg/other", TestDepPkgs: []*Package{cache}}
+	server := &Package{Dir: "cmd/server", Target: "server", IsCmd: true, DepPkgs: []*Package{cache}}
+	Packages = map[string]*Package{
+		`"pkg/db"`:     db,
+		`"pkg/cache"`:  cache,
+		`"pkg/other"`:  other,
+		`"server"-cmd`: server,
+	}
+
+	Test = false
+	affected := AffectedTargets([]string{"pkg/db/db.go", "README"})
+	if len(affected) != 3 || !affected[db] || !affected[cache] || !affected[server] {
+		t.Error(fmt.Sprintf("AffectedTargets -> %v", affected.Sorted()))
+	}
+	if affected := AffectedTargets([]string{"pkg/db/testdata/rows.csv"}); len(affected) != 3 || !affected[db] {
+		t.Error(fmt.Sprintf("AffectedTargets of testdata -> %v", affected.Sorted()))
+	}
+	if affected := AffectedTargets([]string{"overrides.gb"}); len(affected) != 4 {
+		t.Error(fmt.Sprintf("AffectedTargets of overrides.gb -> %v", affected.Sorted()))
+	}
+	if affected := AffectedTargets([]string{"docs/notes.txt"}); len(affected) != 0 {
+		t.Error(fmt.Sprintf("AffectedTargets of docs -> %v", affected.Sorted()))
+	}
+	Test = true
+	if affected := AffectedTargets([]string{"pkg/db/db_test.go"}); len(affected) != 4 {
+		t.Error(fmt.Sprintf("AffectedTargets with tests -> %v", affected.Sorted()))
+	}
+}
+
+func TestBisectArgs(t *testing.T) {
+	for spec, want := range map[string]string{
+		"v1..v2": "v1 v2",
+		"v1":     "v1 HEAD",
+		"v1..":   "v1 HEAD",
+	} {
+		good, bad, err := BisectRange(spec)
+		if err != nil || good+" "+bad != want {
+			t.Error(fmt.Sprintf("BisectRange(%q) -> %q %q %v", spec, good, bad, err))
+		}
+	}
+	if _, _, err := BisectRange("..v2"); err == nil {
+		t.Error("BisectRange(\"..v2\") didn't fail")
+	}
+
+	flags, targets, since := BisectArgs([]string{"-t", "--bisect=v1..v2", "cmd/server"})
+	if strings.Join(flags, " ") != "-t" || strings.Join(targets, " ") != "cmd/server" || since {
+		t.Error(fmt.Sprintf("BisectArgs -> %v %v %v", flags, targets, since))
+	}
+	flags, targets, since = BisectArgs([]string{"--since=v0", "--bisect=v1"})
+	if strings.Join(flags, " ") != "--since=v0" || len(targets) != 0 || !since {
+		t.Error(fmt.Sprintf("BisectArgs with --since -> %v %v %v", flags, targets, since))
+	}
+
+	exists := func(dir string) bool { return dir != "pkg/new" }
+	got := BisectTargets([]string{"cmd/server", "pkg/new"}, []string{"cmd"}, exists)
+	if strings.Join(got, " ") != "cmd/server" {
+		t.Error(fmt.Sprintf("BisectTargets -> %v", got))
+	}
+	// nothing affected, or nothing affected there yet: the listed targets
+	for _, affected := range [][]string{nil, []string{"pkg/new"}} {
+		got = BisectTargets(affected, []string{"cmd"}, exists)
+		if strings.Join(got, " ") != "cmd" {
+			t.Error(fmt.Sprintf("BisectTargets(%v) -> %v", affected, got))
+		}
+	}
+
+	// a step that builds nothing would always pass
+	savedBuild, savedBisect, savedQuery, savedReporting := Build, Bisect, Query, Reporting
+	defer func() {
+		Build, Bisect, Query, Reporting = savedBuild, savedBisect, savedQuery, savedReporting
+	}()
+	Build, Bisect, Query, Reporting = false, "", "", false
+	if !CheckLongFlag("bisect=v1..v2") || !CheckLongFlag("query=*") {
+		t.Fatal("--bisect or --query not accepted")
+	}
+	SetBuild()
+	if err := TryBisect(); err == nil || !strings.Contains(err.String(), "--query") {
+		t.Error(fmt.Sprintf("TryBisect with --query -> %v", err))
+	}
+}
+
+func TestBisectLoop(t *testing.T) {
+	for _, c := range []struct {
+		ok, skip bool
+		want     string
+	}{
+		{true, false, "good"},
+		{false, false, "bad"},
+		{true, true, "skip"},
+		{false, true, "skip"},
+	} {
+		if got := BisectVerdict(c.ok, c.skip); got != c.want {
+			t.Error(fmt.Sprintf("BisectVerdict(%v, %v) -> %s", c.ok, c.skip, got))
+		}
+	}
+
+	out := "c0ffee1234 is the first bad commit\ncommit c0ffee1234\nAuthor: someone\n"
+	if sha, found := FirstBadCommit(out); !found || sha != "c0ffee1234" {
+		t.Error(fmt.Sprintf("FirstBadCommit -> %q %v", sha, found))
+	}
+	if sha, found := FirstBadCommit("Bisecting: 3 revisions left to test after this\n"); found {
+		t.Error(fmt.Sprintf("FirstBadCommit found %q while bisecting", sha))
+	}
+
+	history := []string{"c0", "c1", "c2", "c3", "c4", "c5", "c6"}
+	bisect := func(firstBad int, unbuildable map[int]bool) (first string, marks []string, err os.Error) {
+		git, step, calls := fakeGit(history, firstBad, unbuildable)
+		out, _ := git("bisect", "start", "c6", "c0")
+		first, err = BisectLoop(out, step, func(verdict string) (string, os.Error) {
+			return git("bisect", verdict)
+		})
+		marks = (*calls)[1:]
+		return
+	}
+
+	first, marks, err := bisect(4, nil)
+	if err != nil || first != "c4" {
+		t.Error(fmt.Sprintf("BisectLoop -> %q %v after %v", first, err, marks))
+	}
+	// c3 can't be built, c4 can and works, and c5 is broken
+	first, marks, err = bisect(5, map[int]bool{3: true})
+	if err != nil || first != "c5" || strings.Join(marks, ",") != "bisect skip,bisect good,bisect bad" {
+		t.Error(fmt.Sprintf("BisectLoop with a skip -> %q %v after %v", first, err, marks))
+	}
+	first, marks, err = bisect(4, map[int]bool{2: true, 3: true})
+	if err == nil {
+		t.Error(fmt.Sprintf("BisectLoop with c3 and c2 skipped -> %q after %v", first, marks))
+	}
+}
+
+// fakeGit plays git checkout, clean and bisect over a history where firstBad
+// broke the build and the unbuildable commits can't be built at all. It
+// returns the step that tries the commit checked out, and the git commands
+// run so far.
+func fakeGit(history []string, firstBad int, unbuildable map[int]bool) (git func(args ...string) (string, os.Error), step func() (ok, skip bool, err os.Error), calls *[]string) {
+	good, bad, cur := 0, len(history)-1, 0
+	skipped := make(map[int]bool)
+	calls = new([]string)
+	index := func(rev string) int {
+		for i, sha := range history {
+			if sha == rev {
+				return i
+			}
+		}
+		return -1
+	}
+	next := func() string {
+		if bad-good == 1 {
+			return history[bad] + " is the first bad commit\n"
+		}
+		for i := (good + bad) / 2; i < bad; i++ {
+			if !skipped[i] {
+				cur = i
+				return "Bisecting: a few revisions left to test after this\n"
+			}
+		}
+		for i := (good + bad) / 2; i > good; i-- {
+			if !skipped[i] {
+				cur = i
+				return "Bisecting: a few revisions left to test after this\n"
+			}
+		}
+		return "There are only 'skip'ped commits left to test.\nThe first bad commit could be any of:\n"
+	}
+
+	git = func(args ...string) (string, os.Error) {
+		*calls = append(*calls, strings.Join(args, " "))
+		switch args[0] {
+		case "checkout":
+			cur = index(args[len(args)-1])
+		case "bisect":
+			switch args[1] {
+			case "start":
+				bad, good = index(args[2]), index(args[3])
+			case "good":
+				good = cur
+			case "bad":
+				bad = cur
+			case "skip":
+				skipped[cur] = true
+			}
+			return next(), nil
+		}
+		return "", nil
+	}
+	step = func() (ok, skip bool, err os.Error) {
+		if unbuildable[cur] {
+			return false, true, nil
+		}
+		return cur < firstBad, false, nil
+	}
+	return
+}
+
+func TestBisectRun(t *testing.T) {
+	history := []string{"c0", "c1", "c2", "c3", "c4", "c5", "c6"}
+	git, step, calls := fakeGit(history, 4, nil)
+	first, err := BisectRun("c0", "c6", git, step)
+	if err != nil || first != "c4" {
+		t.Error(fmt.Sprintf("BisectRun -> %q %v", first, err))
+	}
+	// both ends are tried from a clean checkout before git bisect starts
+	want := strings.Join([]string{
+		"checkout -q -f c6", "clean -q -x -d -f",
+		"checkout -q -f c0", "clean -q -x -d -f",
+		"bisect start c6 c0", "clean -q -x -d -f",
+	}, ",")
+	if got := strings.Join(*calls, ","); !strings.HasPrefix(got, want) {
+		t.Error(fmt.Sprintf("BisectRun ran %s", got))
+	}
+
+	for _, c := range []struct {
+		firstBad    int
+		unbuildable map[int]bool
+		want        string
+	}{
+		{7, nil, "c6 isn't broken"},
+		{0, nil, "c0 is already broken"},
+		{4, map[int]bool{6: true}, "c6 can't be tried: the workspace isn't there"},
+		{4, map[int]bool{0: true}, "c0 can't be tried: the workspace isn't there"},
+	} {
+		git, step, calls = fakeGit(history, c.firstBad, c.unbuildable)
+		if _, err = BisectRun("c0", "c6", git, step); err == nil || err.String() != c.want {
+			t.Error(fmt.Sprintf("BisectRun -> %v, was expecting %q", err, c.want))
+		}
+		for _, call := range *calls {
+			if strings.HasPrefix(call, "bisect") {
+				t.Error(fmt.Sprintf("BisectRun ran git %s after %q", call, c.want))
+			}
+		}
+	}
+}
+
 func BenchmarkX(b *testing.B) {
 	//do nothing
 }
@@ -17,6 +17,10 @@
 package main
 
 import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"exp/template"
 )
 /*
@@ -67,7 +71,10 @@ include $(GOROOT)/src/Make.inc
 TARG={{.Target}}
 GOFILES=\
 {{range .GoFiles}}	{{.}}\
-{{end}}
+{{end}}{{if .AsmObjs}}
+OFILES=\
+{{range .AsmObjs}}	{{.}}\
+{{end}}{{end}}
 # gb: this is the local install
 GBROOT={{.GBROOT}}
 
@@ -76,7 +83,10 @@ GC+= -I $(GBROOT)/_obj
 LD+= -L $(GBROOT)/_obj{{if .GOPATHS}}
 # gb: compile/link against GOPATH entries{{range .GOPATHS}}
 GC+= -I {{.}}/pkg/$(GOOS)_$(GOARCH)
-LD+= -L {{.}}/pkg/$(GOOS)_$(GOARCH){{end}}{{end}}
+LD+= -L {{.}}/pkg/$(GOOS)_$(GOARCH){{end}}{{end}}{{if .InstallDir}}
+
+# gb: install into the chosen GOPATH entry
+TARGDIR={{.InstallDir}}{{end}}
 
 # gb: default target is in GBROOT this way
 command:
@@ -161,19 +171,29 @@ GOFILES=\
 {{range .GoFiles}}	{{.}}\
 {{end}}{{if .AsmObjs}}
 
-OFiles=\
+OFILES=\
 {{range .AsmObjs}}	{{.}}\
 {{end}}
 {{end}}{{if .CGoFiles}}
 
 CGOFILES=\
-{{if .CGoFiles}}	{{.}}\
+{{range .CGoFiles}}	{{.}}\
 {{end}}
 {{end}}{{if .CObjs}}
 
 CGO_OFILES=\
 {{range .CObjs}}	{{.}}\
 {{end}}
+{{end}}{{if .CGoCFlags}}
+# gb: CFLAGS from #cgo directives
+CGO_CFLAGS+={{range .CGoCFlags}} {{.}}{{end}}
+{{end}}{{if .CGoLDFlags}}
+# gb: LDFLAGS from #cgo directives
+CGO_LDFLAGS+={{range .CGoLDFlags}} {{.}}{{end}}
+{{end}}{{if .TestSources}}
+GOTESTFILES=\
+{{range .TestSources}}	{{.}}\
+{{end}}
 {{end}}
 # gb: this is the local install
 GBROOT={{.GBROOT}}
@@ -183,7 +203,10 @@ GC+= -I $(GBROOT)/{{.BuildDirPkg}}
 LD+= -L $(GBROOT)/{{.BuildDirPkg}}{{if .GOPATHS}}
 # gb: compile/link against GOPATH entries{{range .GOPATHS}}
 GC+= -I {{.}}/pkg/$(GOOS)_$(GOARCH)
-LD+= -L {{.}}/pkg/$(GOOS)_$(GOARCH){{end}}{{end}}
+LD+= -L {{.}}/pkg/$(GOOS)_$(GOARCH){{end}}{{end}}{{if .InstallDir}}
+
+# gb: install into the chosen GOPATH entry
+TARGDIR={{.InstallDir}}{{end}}
 {{if .CopyLocal}}
 # gb: copy to local install
 $(GBROOT)/{{.BuildDirPkg}}/$(TARG).a: {{.BuildDirPkg}}/$(TARG).a
@@ -195,21 +218,119 @@ include $(GOROOT)/src/Make.pkg
 {{if .LocalDeps}}
 # gb: local dependencies{{if $BuildDirPkg=.BuildDirPkg}}
 {{range .LocalDeps}}{{$BuildDirPkg}}/$(TARG).a: $(GBROOT)/{{$BuildDirPkg}}/{{.}}.a
+{{end}}{{end}}{{end}}{{if .LocalTestDeps}}
+# gb: local dependencies of the tests{{if $BuildDirPkg=.BuildDirPkg}}
+{{range .LocalTestDeps}}testpackage: $(GBROOT)/{{$BuildDirPkg}}/{{.}}.a
 {{end}}{{end}}{{end}}`)
 	if err != nil { panic(err)}
 	return t
 }()
 
+var BuildTemplateExp = func() *template.Template {
+	t := template.New("Build")
+	err := t.Parse(
+	`# Build script generated by gb: http://go-gb.googlecode.com
+# gb provides configuration-free building and distributing
+
+echo "Build script generated by gb: http://go-gb.googlecode.com" 
+if [ "$1" = "goinstall" ]; then
+SRC="${GOPATH:+${GOPATH%%:*}/src}"
+SRC="${SRC:-$GOROOT/src/pkg}"
+echo Running goinstall \
+{{range .Fetches}}&& echo "fetching {{.Root}}" \
+&& ( [ -d "$SRC/{{.Root}}" ] || {{.Clone}}"$SRC/{{.Root}}" ) \
+{{end}}{{range .GoInstalls}}&& echo "goinstall {{.}}" \
+&& goinstall {{.}} \
+{{end}}
+else
+echo Building \
+{{range .Targets}}&& echo "(in {{.Dir}})" && cd {{.Dir}} && make $1 && cd - > /dev/null \
+{{end}}
+fi
+
+# The makefiles above are invoked in topological dependence order
+`)
+	if err != nil { panic(err)}
+	return t
+}()
+
+// the first line of every makefile gb writes with the built-in templates
+var GeneratedMakefileHeader = "# Makefile generated by gb"
+
+// workspace files that replace the built-in templates above
+var MakeCmdTemplateFile = "makecmd.gb"
+var MakePkgTemplateFile = "makepkg.gb"
+var BuildTemplateFile = "buildscript.gb"
+
+var MakeCmdTemplate, MakePkgTemplate, BuildTemplate *template.Template
+
+func LoadTemplate(name, file string, builtin *template.Template) (t *template.Template, err os.Error) {
+	p := filepath.Join(CWD, file)
+	if _, serr := os.Stat(p); serr != nil {
+		// there's no such file, so the built-in template it is
+		return builtin, nil
+	}
+	var text []byte
+	if text, err = ioutil.ReadFile(p); err != nil {
+		err = os.NewError(fmt.Sprintf("%s: %v", file, err))
+		return
+	}
+	if Verbose {
+		fmt.Printf("Using %s from %s\n", name, file)
+	}
+	t = template.New(name)
+	if err = t.Parse(string(text)); err != nil {
+		err = os.NewError(fmt.Sprintf("%s: %v", file, err))
+	}
+	return
+}
+
+func LoadTemplates() (err os.Error) {
+	if BuildTemplate != nil {
+		return
+	}
+	if MakeCmdTemplate, err = LoadTemplate("MakeCmd", MakeCmdTemplateFile, MakeCmdTemplateExp); err != nil {
+		return
+	}
+	if MakePkgTemplate, err = LoadTemplate("MakePkg", MakePkgTemplateFile, MakePkgTemplateExp); err != nil {
+		return
+	}
+	BuildTemplate, err = LoadTemplate("Build", BuildTemplateFile, BuildTemplateExp)
+	return
+}
+
+type BuildData struct {
+	GoInstalls []string
+	Fetches    []FetchData
+	Targets    []MakeData
+}
+
+// a repository on a host from hosts.gb, which goinstall can't download itself
+type FetchData struct {
+	Root  string
+	VCS   string
+	URL   string
+	Clone string // the clone command, missing only its destination
+}
+
 type MakeData struct {
-	Target      string
-	GBROOT      string
-	GoFiles     []string
-	AsmObjs     []string
-	CGoFiles    []string
-	CObjs       []string
-	LocalDeps   []string
-	BuildDirPkg string
-	BuildDirCmd string
-	CopyLocal   bool
-	GOPATHS     []string
+	Dir           string
+	Target        string
+	IsCmd         bool
+	GBROOT        string
+	GoFiles       []string
+	AsmObjs       []string
+	CGoFiles      []string
+	CObjs         []string
+	CGoCFlags     []string
+	CGoLDFlags    []string
+	TestSources   []string
+	Deps          []string
+	LocalDeps     []string
+	LocalTestDeps []string
+	BuildDirPkg   string
+	BuildDirCmd   string
+	CopyLocal     bool
+	GOPATHS       []string
+	InstallDir    string // TARGDIR, when installing into a GOPATH entry
 }
@@ -17,19 +17,280 @@
 package main
 
 import (
+	"os"
+	"exec"
 	"regexp"
 	"fmt"
 	"path"
+	"path/filepath"
 	"strings"
 )
 
+// a host that goinstall, or gb, knows how to fetch from
+type RemoteHost struct {
+	Pattern *regexp.Regexp
+	VCS     string // empty when the VCS is spelled out in the import path
+	URL     string // where gb fetches from, for hosts goinstall doesn't know
+}
+
 //taken from goinstall source
-var goinstallables = []*regexp.Regexp{
-	regexp.MustCompile(`^([a-z0-9\-]+\.googlecode\.com/(svn|hg))(/[a-z0-9A-Z_.\-/]*)?$`),
-	regexp.MustCompile(`^(github\.com/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)(/[a-z0-9A-Z_.\-/]*)?$`),
-	regexp.MustCompile(`^(bitbucket\.org/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)(/[a-z0-9A-Z_.\-/]*)?$`),
-	regexp.MustCompile(`^(launchpad\.net/([a-z0-9A-Z_.\-]+(/[a-z0-9A-Z_.\-]+)?|~[a-z0-9A-Z_.\-]+/(\+junk|[a-z0-9A-Z_.\-]+)/[a-z0-9A-Z_.\-]+))(/[a-z0-9A-Z_.\-/]+)?$`),
-	regexp.MustCompile(`.+{\.hg|\.git|\.bzr|\.svn}[/.*]`),
+var goinstallables = []*RemoteHost{
+	&RemoteHost{regexp.MustCompile(`^([a-z0-9\-]+\.googlecode\.com/(svn|hg))(/[a-z0-9A-Z_.\-/]*)?$`), "", ""},
+	&RemoteHost{regexp.MustCompile(`^(github\.com/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)(/[a-z0-9A-Z_.\-/]*)?$`), "git", ""},
+	&RemoteHost{regexp.MustCompile(`^(bitbucket\.org/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)(/[a-z0-9A-Z_.\-/]*)?$`), "hg", ""},
+	&RemoteHost{regexp.MustCompile(`^(launchpad\.net/([a-z0-9A-Z_.\-]+(/[a-z0-9A-Z_.\-]+)?|~[a-z0-9A-Z_.\-]+/(\+junk|[a-z0-9A-Z_.\-]+)/[a-z0-9A-Z_.\-]+))(/[a-z0-9A-Z_.\-/]+)?$`), "bzr", ""},
+	&RemoteHost{regexp.MustCompile(`.+{\.hg|\.git|\.bzr|\.svn}[/.*]`), "", ""},
+}
+
+var vcsSuffixes = []string{"hg", "git", "bzr", "svn"}
+
+// hosts.gb adds hosts to goinstallables, one per line, as
+//	<pattern> <vcs> <url>
+// where the first group in the pattern is the repository root, and {root},
+// {1}, {2}, etc. in the url are replaced by the matched groups.
+var RemoteHostsFile = "hosts.gb"
+
+func LoadRemoteHosts() (err os.Error) {
+	var hosts []*RemoteHost
+	err = ReadConfig(RemoteHostsFile, func(lineno int, fields []string) (err os.Error) {
+		if len(fields) != 3 {
+			return os.NewError(`expected "pattern vcs url"`)
+		}
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(fields[0]); err != nil {
+			return
+		}
+		if re.NumSubexp() < 1 {
+			return os.NewError("the pattern needs a group for the repository root")
+		}
+		if CloneArgs(fields[1], "", "") == nil {
+			return os.NewError(fmt.Sprintf("unknown vcs %q, expected git, hg, svn or bzr", fields[1]))
+		}
+		hosts = append(hosts, &RemoteHost{re, fields[1], fields[2]})
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	// the workspace's own hosts take precedence
+	goinstallables = append(hosts, goinstallables...)
+	return
+}
+
+// RemoteURL returns where gb should fetch target's repository from, if target
+// is on a host that goinstall doesn't know about.
+func RemoteURL(target string) (vcs, root, url string, ok bool) {
+	target = strings.Trim(target, "\"")
+
+	for _, host := range goinstallables {
+		m := host.Pattern.FindStringSubmatch(target)
+		if m == nil {
+			continue
+		}
+		if host.URL == "" {
+			return
+		}
+		vcs, root, url, ok = host.VCS, m[1], host.URL, true
+		url = strings.Replace(url, "{root}", root, -1)
+		for i := 1; i < len(m) && i < 10; i++ {
+			url = strings.Replace(url, fmt.Sprintf("{%d}", i), m[i], -1)
+		}
+		return
+	}
+	return
+}
+
+// CloneArgs returns the command that makes a new checkout of url in dir.
+func CloneArgs(vcs, url, dir string) (argv []string) {
+	switch vcs {
+	case "git":
+		argv = []string{"git", "clone", "-q", url, dir}
+	case "hg":
+		argv = []string{"hg", "clone", "-q", url, dir}
+	case "svn":
+		argv = []string{"svn", "checkout", "-q", url, dir}
+	case "bzr":
+		argv = []string{"bzr", "branch", "-q", url, dir}
+	}
+	return
+}
+
+// PullArgs returns the command that updates an existing checkout.
+func PullArgs(vcs string) (argv []string) {
+	switch vcs {
+	case "git":
+		argv = []string{"git", "pull", "-q"}
+	case "hg":
+		argv = []string{"hg", "pull", "-q", "-u"}
+	case "svn":
+		argv = []string{"svn", "update", "-q"}
+	case "bzr":
+		argv = []string{"bzr", "pull", "-q"}
+	}
+	return
+}
+
+// FetchRemote puts the source for target where goinstall would have, for hosts
+// that goinstall can't download from itself.
+func FetchRemote(target string) (err os.Error) {
+	vcs, root, url, ok := RemoteURL(target)
+	if !ok {
+		return
+	}
+
+	srcroot := filepath.Join(GOROOT, "src", "pkg")
+	if GOPATH_SINGLE != "" {
+		srcroot = filepath.Join(GOPATH_SINGLE, "src")
+	}
+	repo := filepath.Join(srcroot, root)
+
+	argv := CloneArgs(vcs, url, repo)
+	wd := "."
+	if _, serr := os.Stat(repo); serr == nil {
+		if !GoInstallUpdate {
+			return
+		}
+		argv = PullArgs(vcs)
+		wd = repo
+	} else {
+		parent, _ := filepath.Split(repo)
+		if err = RunMkdirAll(parent); err != nil {
+			return
+		}
+	}
+	if argv == nil {
+		err = os.NewError(fmt.Sprintf("don't know how to fetch with %s", vcs))
+		return
+	}
+
+	var cmd string
+	if cmd, err = exec.LookPath(argv[0]); err != nil {
+		return
+	}
+	fmt.Printf("%v\n", argv)
+	err = RunExternal(cmd, wd, argv)
+	return
+}
+
+// RemoteRepo returns the version control system and the repository root of a
+// goinstallable import path.
+func RemoteRepo(target string) (vcs, root string, ok bool) {
+	target = strings.Trim(target, "\"")
+
+	for _, host := range goinstallables {
+		m := host.Pattern.FindStringSubmatch(target)
+		if m == nil {
+			continue
+		}
+		ok = true
+		vcs, root = host.VCS, target
+		if len(m) > 1 {
+			root = m[1]
+		}
+		if vcs == "" {
+			// googlecode.com/hg, or example.com/repo.git/...
+			for _, suffix := range vcsSuffixes {
+				if strings.HasSuffix(root, "/"+suffix) {
+					vcs = suffix
+					break
+				}
+				if i := strings.Index(target, "."+suffix); i != -1 {
+					vcs = suffix
+					root = target[:i+len(suffix)+1]
+					break
+				}
+			}
+		}
+		return
+	}
+
+	return
+}
+
+// VCSRoot finds the root of the checkout that dir is in, and its VCS.
+func VCSRoot(dir string) (vcs, root string, ok bool) {
+	root = GetAbs(dir, CWD)
+	for {
+		// in a git worktree or submodule, .git is a file
+		if _, err := os.Stat(filepath.Join(root, ".git")); err == nil {
+			return "git", root, true
+		}
+		if isDir(filepath.Join(root, ".hg")) {
+			return "hg", root, true
+		}
+		parent, _ := filepath.Split(root)
+		parent = filepath.Clean(parent)
+		if parent == root {
+			break
+		}
+		root = parent
+	}
+	return
+}
+
+// RemoteImportPath turns a repository's clone url into the import path that
+// goinstall would fetch it by.
+func RemoteImportPath(url string) (ipath string, ok bool) {
+	ipath = strings.TrimSpace(url)
+	if i := strings.Index(ipath, "://"); i != -1 {
+		ipath = ipath[i+3:]
+	} else if i := strings.Index(ipath, ":"); i > 1 && !strings.Contains(ipath[:i], "/") {
+		// scp-like syntax, user@host:path
+		ipath = ipath[:i] + "/" + ipath[i+1:]
+	} else {
+		// a local path
+		return
+	}
+	if i := strings.Index(ipath, "@"); i != -1 && i < strings.Index(ipath+"/", "/") {
+		ipath = ipath[i+1:]
+	}
+	if i := strings.Index(ipath, "/"); i != -1 {
+		if j := strings.Index(ipath[:i], ":"); j != -1 {
+			// drop the port
+			ipath = ipath[:j] + ipath[i:]
+		}
+	}
+	ipath = strings.TrimRight(ipath, "/")
+	if strings.HasSuffix(ipath, ".git") && IsGoInstallable(ipath[:len(ipath)-len(".git")]) {
+		ipath = ipath[:len(ipath)-len(".git")]
+	}
+	ok = IsGoInstallable(ipath)
+	return
+}
+
+var vcsTargetRoots = make(map[string]string)
+
+// VCSTarget names the package in dir by its repository's remote url and its
+// path within the repository, or returns "" if it can't.
+func VCSTarget(dir string) (target string) {
+	vcs, root, ok := VCSRoot(dir)
+	if !ok {
+		return
+	}
+	base, cached := vcsTargetRoots[root]
+	if !cached {
+		var argv []string
+		switch vcs {
+		case "git":
+			argv = []string{"git", "config", "--get", "remote.origin.url"}
+		case "hg":
+			argv = []string{"hg", "paths", "default"}
+		}
+		if out, err := RunExternalOutput(root, argv); err == nil {
+			if ipath, ok := RemoteImportPath(out); ok {
+				base = ipath
+			}
+		}
+		vcsTargetRoots[root] = base
+		if base == "" {
+			ErrLog.Printf("(in %s) can't tell the import path of the %s remote\n", GetRelative(CWD, root, CWD), vcs)
+		}
+	}
+	if base == "" {
+		return
+	}
+	return path.Join(base, filepath.ToSlash(GetRelative(root, GetAbs(dir, CWD), CWD)))
 }
 
 var goinstalledAlready = make(map[string]bool)
@@ -37,8 +298,8 @@ var goinstalledAlready = make(map[string]bool)
 func IsGoInstallable(target string) (matches bool) {
 	target = strings.Trim(target, "\"")
 
-	for _, re := range goinstallables {
-		if m := re.FindStringSubmatch(target); m != nil {
+	for _, host := range goinstallables {
+		if m := host.Pattern.FindStringSubmatch(target); m != nil {
 			matches = true
 			break
 		}
@@ -57,12 +318,26 @@ func GoInstallPkg(target string) (touched int64) {
 		return
 	}
 
+	// remote packages come from the mirror and are built as targets
+	if MirrorDir != "" {
+		return
+	}
+
 	target = strings.Trim(target, "\"")
 
 	argv := []string{"goinstall", target}
 	if GoInstallUpdate {
 		argv = []string{"goinstall", "-u", "-clean", target}
 	}
+
+	if _, _, _, ok := RemoteURL(target); ok {
+		// goinstall can build it once it's been fetched, but can't fetch it
+		if err := FetchRemote(target); err != nil {
+			ErrLog.Printf("%v\n", err)
+			return
+		}
+		argv = []string{"goinstall", "-clean", target}
+	}
 	//if Verbose {
 	fmt.Printf("%v\n", argv)
 	//}
@@ -71,8 +346,6 @@ func GoInstallPkg(target string) (touched int64) {
 		return
 	}
 
-	goinstalledFile := path.Join(GetInstallDirPkg(), target) + ".a"
-
-	touched, _ = StatTime(goinstalledFile)
+	_, touched = PkgExistsInGOROOT(target)
 	return
 }
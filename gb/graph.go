@@ -0,0 +1,800 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"json"
+	"path"
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// --query=EXPR prints the targets that EXPR, in this language, evaluates to:
+//	deps(e)          everything the targets in e import, directly or not
+//	rdeps(e)         every target that imports one in e, directly or not
+//	testdeps(e)      like deps, but starting from the tests' imports too
+//	kind(k, e)       the targets in e that are cmds, pkgs or cgo pkgs
+//	loc(l, e)        the targets in e in the workspace, vendor, mirror,
+//	                 gopath or goroot
+//	stale(e)         the targets in e that need to be built
+//	e | e, e & e, e - e
+//	                 union, intersection and difference, from left to right
+//	*                every scanned target
+//	name, dir/...    a target by name or directory, or all under a prefix
+var Query string
+
+// --format=names|dirs|json says how --query prints its result
+var QueryFormat = "names"
+
+type TargetSet map[*Package]bool
+
+func (this TargetSet) Sorted() (pkgs []*Package) {
+	var keys []string
+	byKey := make(map[string]*Package)
+	for pkg := range this {
+		key := pkg.Target + "\x00" + pkg.Dir
+		keys = append(keys, key)
+		byKey[key] = pkg
+	}
+	sort.StringSlice(keys).Sort()
+	for _, key := range keys {
+		pkgs = append(pkgs, byKey[key])
+	}
+	return
+}
+
+// AllTargets returns each scanned package once, although overridden imports
+// and cmds are keyed more than once in Packages.
+func AllTargets() (all TargetSet) {
+	all = make(TargetSet)
+	for _, pkg := range Packages {
+		all[pkg] = true
+	}
+	return
+}
+
+// LookupTarget finds the packages a query names, by target or directory. A
+// name ending in "/..." matches everything under it.
+func LookupTarget(name string) (pkgs []*Package, err os.Error) {
+	name = strings.Trim(name, "\"")
+	prefix := ""
+	if name == "..." {
+		prefix = "*"
+	} else if strings.HasSuffix(name, "/...") {
+		prefix = name[:len(name)-len("/...")]
+	}
+	for pkg := range AllTargets() {
+		if prefix != "" {
+			if importHasPrefix(pkg.Target, prefix) || importHasPrefix(pkg.Dir, prefix) {
+				pkgs = append(pkgs, pkg)
+			}
+		} else if pkg.Target == name || pkg.Dir == name {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	if len(pkgs) == 0 {
+		err = os.NewError(fmt.Sprintf("no target matches %q", name))
+	}
+	return
+}
+
+// PkgKind is "cmd", "cgo" or "pkg"
+func (this *Package) PkgKind() string {
+	if this.IsCmd {
+		return "cmd"
+	}
+	if this.IsCGo {
+		return "cgo"
+	}
+	return "pkg"
+}
+
+// PkgLocation is "goroot", "gopath", "vendor", "mirror" or "workspace"
+func (this *Package) PkgLocation() string {
+	switch {
+	case this.IsInGOROOT:
+		return "goroot"
+	case this.IsInGOPATH != "":
+		return "gopath"
+	case this.IsVendored:
+		return "vendor"
+	case this.IsMirrored:
+		return "mirror"
+	}
+	return "workspace"
+}
+
+func (this TargetSet) Deps(withTests bool) (deps TargetSet) {
+	deps = make(TargetSet)
+	var visit func(pkg *Package)
+	visit = func(pkg *Package) {
+		for _, dp := range pkg.DepPkgs {
+			if !deps[dp] {
+				deps[dp] = true
+				visit(dp)
+			}
+		}
+	}
+	for pkg := range this {
+		visit(pkg)
+		if withTests {
+			for _, dp := range pkg.TestDepPkgs {
+				if !deps[dp] {
+					deps[dp] = true
+					visit(dp)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (this TargetSet) RDeps() (rdeps TargetSet) {
+	importers := make(map[*Package][]*Package)
+	for pkg := range AllTargets() {
+		for _, dp := range pkg.DepPkgs {
+			importers[dp] = append(importers[dp], pkg)
+		}
+	}
+	rdeps = make(TargetSet)
+	var visit func(pkg *Package)
+	visit = func(pkg *Package) {
+		for _, ip := range importers[pkg] {
+			if !rdeps[ip] {
+				rdeps[ip] = true
+				visit(ip)
+			}
+		}
+	}
+	for pkg := range this {
+		visit(pkg)
+	}
+	return
+}
+
+func (this TargetSet) Filter(keep func(pkg *Package) bool) (kept TargetSet) {
+	kept = make(TargetSet)
+	for pkg := range this {
+		if keep(pkg) {
+			kept[pkg] = true
+		}
+	}
+	return
+}
+
+type queryParser struct {
+	tokens []string
+}
+
+func tokenizeQuery(expr string) (tokens []string) {
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexRune("()|&,-", int(c)) != -1:
+			// a '-' only starts a token as the difference operator, since
+			// targets may contain but never start with one
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		default:
+			j := i
+			for j < len(expr) && strings.IndexRune(" \t\n()|&,", int(expr[j])) == -1 {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return
+}
+
+func (this *queryParser) next() (token string) {
+	if len(this.tokens) != 0 {
+		token = this.tokens[0]
+		this.tokens = this.tokens[1:]
+	}
+	return
+}
+
+func (this *queryParser) peek() (token string) {
+	if len(this.tokens) != 0 {
+		token = this.tokens[0]
+	}
+	return
+}
+
+func (this *queryParser) expect(token string) (err os.Error) {
+	if got := this.next(); got != token {
+		err = os.NewError(fmt.Sprintf("expected %q in query, found %q", token, got))
+	}
+	return
+}
+
+func (this *queryParser) expr() (set TargetSet, err os.Error) {
+	if set, err = this.term(); err != nil {
+		return
+	}
+	for {
+		op := this.peek()
+		if op != "|" && op != "&" && op != "-" {
+			return
+		}
+		this.next()
+		var rhs TargetSet
+		if rhs, err = this.term(); err != nil {
+			return
+		}
+		switch op {
+		case "|":
+			for pkg := range rhs {
+				set[pkg] = true
+			}
+		case "&":
+			set = set.Filter(func(pkg *Package) bool { return rhs[pkg] })
+		case "-":
+			set = set.Filter(func(pkg *Package) bool { return !rhs[pkg] })
+		}
+	}
+	return
+}
+
+func (this *queryParser) term() (set TargetSet, err os.Error) {
+	token := this.next()
+	switch token {
+	case "":
+		err = os.NewError("unexpected end of query")
+		return
+	case "(":
+		if set, err = this.expr(); err != nil {
+			return
+		}
+		err = this.expect(")")
+		return
+	case ")", "|", "&", "-", ",":
+		err = os.NewError(fmt.Sprintf("unexpected %q in query", token))
+		return
+	case "*":
+		set = AllTargets()
+		return
+	}
+
+	if this.peek() != "(" {
+		var pkgs []*Package
+		if pkgs, err = LookupTarget(token); err != nil {
+			return
+		}
+		set = make(TargetSet)
+		for _, pkg := range pkgs {
+			set[pkg] = true
+		}
+		return
+	}
+	this.next()
+
+	var arg string
+	switch token {
+	case "kind", "loc":
+		arg = this.next()
+		if err = this.expect(","); err != nil {
+			return
+		}
+	}
+	var inner TargetSet
+	if inner, err = this.expr(); err != nil {
+		return
+	}
+	if err = this.expect(")"); err != nil {
+		return
+	}
+
+	switch token {
+	case "deps":
+		set = inner.Deps(false)
+	case "testdeps":
+		set = inner.Deps(true)
+	case "rdeps":
+		set = inner.RDeps()
+	case "kind":
+		if arg != "cmd" && arg != "pkg" && arg != "cgo" {
+			err = os.NewError(fmt.Sprintf("unknown kind %q in query", arg))
+			return
+		}
+		set = inner.Filter(func(pkg *Package) bool { return pkg.PkgKind() == arg })
+	case "loc":
+		switch arg {
+		case "goroot", "gopath", "vendor", "mirror", "workspace":
+		default:
+			err = os.NewError(fmt.Sprintf("unknown location %q in query", arg))
+			return
+		}
+		set = inner.Filter(func(pkg *Package) bool { return pkg.PkgLocation() == arg })
+	case "stale":
+		set = inner.Filter(func(pkg *Package) bool { return pkg.NeedsBuild })
+	default:
+		err = os.NewError(fmt.Sprintf("unknown function %q in query", token))
+	}
+	return
+}
+
+func EvalQuery(expr string) (set TargetSet, err os.Error) {
+	p := &queryParser{tokenizeQuery(expr)}
+	if set, err = p.expr(); err != nil {
+		return
+	}
+	if rest := p.next(); rest != "" {
+		err = os.NewError(fmt.Sprintf("unexpected %q in query", rest))
+	}
+	return
+}
+
+// PrintTargets writes pkgs in the --format chosen.
+func PrintTargets(pkgs []*Package) (err os.Error) {
+	switch QueryFormat {
+	case "names":
+		for _, pkg := range pkgs {
+			fmt.Println(pkg.Target)
+		}
+	case "dirs":
+		for _, pkg := range pkgs {
+			fmt.Println(pkg.Dir)
+		}
+	case "json":
+		var objs []map[string]interface{}
+		for _, pkg := range pkgs {
+			objs = append(objs, map[string]interface{}{
+				"target":   pkg.Target,
+				"dir":      pkg.Dir,
+				"kind":     pkg.PkgKind(),
+				"location": pkg.PkgLocation(),
+				"stale":    pkg.NeedsBuild,
+			})
+		}
+		if objs == nil {
+			objs = []map[string]interface{}{}
+		}
+		var out []byte
+		if out, err = json.MarshalIndent(objs, "", "\t"); err != nil {
+			return
+		}
+		fmt.Println(string(out))
+	}
+	return
+}
+
+// --path=FROM,TO prints the shortest chain of imports from FROM to TO, and
+// --allpaths=FROM,TO every chain
+var PathQuery string
+var AllPaths bool
+
+type importEdge struct {
+	From, To *Package
+	Test     bool
+}
+
+// ImportOf finds the import, quoted, by which this package reaches dep.
+func (this *Package) ImportOf(dep *Package, test bool) (imp string) {
+	deps := this.Deps
+	if test {
+		deps = this.TestDeps
+	}
+	for _, d := range deps {
+		if pkg, ok := LookupImport(d); ok && pkg == dep {
+			return d
+		}
+	}
+	return "\"" + dep.Target + "\""
+}
+
+func (this importEdge) String() string {
+	imp := this.From.ImportOf(this.To, this.Test)
+	var file string
+	if this.Test {
+		file = this.From.TestImportingFile(imp)
+	} else {
+		file = this.From.ImportingFile(imp)
+	}
+	if line := ImportLine(file, imp); line != 0 {
+		file = fmt.Sprintf("%s:%d", file, line)
+	}
+	s := fmt.Sprintf("imports %s in %s", imp, file)
+	if this.Test {
+		s += " (test)"
+	}
+	return s
+}
+
+// the edges out of pkg; tests' imports only count for the packages a path
+// starts from, since that's the only place they are compiled
+func pathEdges(pkg *Package, start bool) (edges []importEdge) {
+	for _, dp := range pkg.DepPkgs {
+		edges = append(edges, importEdge{pkg, dp, false})
+	}
+	if start && Test {
+		for _, dp := range pkg.TestDepPkgs {
+			edges = append(edges, importEdge{pkg, dp, true})
+		}
+	}
+	return
+}
+
+// ShortestPath finds the fewest imports leading from a package in from to
+// one in to, and says whether there are any. When from and to overlap, that
+// takes no imports at all.
+func ShortestPath(from, to TargetSet) (chain []importEdge, found bool) {
+	parent := make(map[*Package]importEdge)
+	seen := make(TargetSet)
+	var queue []*Package
+	for _, pkg := range from.Sorted() {
+		seen[pkg] = true
+		queue = append(queue, pkg)
+	}
+	for len(queue) != 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		if to[pkg] {
+			found = true
+			for !from[pkg] {
+				edge := parent[pkg]
+				chain = append([]importEdge{edge}, chain...)
+				pkg = edge.From
+			}
+			return
+		}
+		for _, edge := range pathEdges(pkg, from[pkg]) {
+			if !seen[edge.To] {
+				seen[edge.To] = true
+				parent[edge.To] = edge
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+	return
+}
+
+// AllPathsBetween lists every chain of imports leading from a package in
+// from to one in to.
+func AllPathsBetween(from, to TargetSet) (paths [][]importEdge) {
+	// only follow imports of packages that can still reach to
+	reaches := to.RDeps()
+	for pkg := range to {
+		reaches[pkg] = true
+	}
+
+	var chain []importEdge
+	onChain := make(TargetSet)
+	var walk func(pkg *Package, start bool)
+	walk = func(pkg *Package, start bool) {
+		if to[pkg] && !start {
+			paths = append(paths, append([]importEdge{}, chain...))
+			return
+		}
+		onChain[pkg] = true
+		for _, edge := range pathEdges(pkg, start) {
+			if !reaches[edge.To] || onChain[edge.To] {
+				continue
+			}
+			chain = append(chain, edge)
+			walk(edge.To, false)
+			chain = chain[:len(chain)-1]
+		}
+		onChain[pkg] = false
+	}
+	for _, pkg := range from.Sorted() {
+		walk(pkg, true)
+	}
+	return
+}
+
+// SplitPathQuery splits FROM,TO at the one comma that isn't inside the
+// parentheses of a query.
+func SplitPathQuery(q string) (ends []string, err os.Error) {
+	depth, start := 0, 0
+	for i, c := range q {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				ends = append(ends, q[start:i])
+				start = i + 1
+			}
+		}
+	}
+	ends = append(ends, q[start:])
+	if len(ends) != 2 {
+		err = os.NewError(fmt.Sprintf("expected FROM,TO, found %q", q))
+	}
+	return
+}
+
+func TryPath() (err os.Error) {
+	if PathQuery == "" {
+		return
+	}
+	ends, err := SplitPathQuery(PathQuery)
+	if err != nil {
+		return
+	}
+	var from, to TargetSet
+	if from, err = EvalQuery(ends[0]); err != nil {
+		return
+	}
+	if to, err = EvalQuery(ends[1]); err != nil {
+		return
+	}
+
+	var paths [][]importEdge
+	if AllPaths {
+		paths = AllPathsBetween(from, to)
+	} else if chain, found := ShortestPath(from, to); found {
+		if len(chain) == 0 {
+			for _, pkg := range from.Filter(func(pkg *Package) bool { return to[pkg] }).Sorted() {
+				fmt.Printf("\"%s\" is in both %s and %s\n", pkg.Target, ends[0], ends[1])
+			}
+			return
+		}
+		paths = append(paths, chain)
+	}
+	if len(paths) == 0 {
+		fmt.Printf("No path from %s to %s\n", ends[0], ends[1])
+		return
+	}
+
+	for i, chain := range paths {
+		if i != 0 {
+			fmt.Println()
+		}
+		fmt.Printf("\"%s\"\n", chain[0].From.Target)
+		for _, edge := range chain {
+			fmt.Printf("\t%v\n", edge)
+		}
+	}
+	return
+}
+
+func TryQuery() (err os.Error) {
+	if Query == "" {
+		return
+	}
+	var set TargetSet
+	if set, err = EvalQuery(Query); err != nil {
+		return
+	}
+	err = PrintTargets(set.Sorted())
+	return
+}
+
+// --files=text|json|dot prints which file makes each import in the listed
+// targets
+var FileGraph string
+
+// --singleuse lists the imports that only one file in a package makes
+var SingleUse bool
+
+func sortedListedPkgs() []*Package {
+	set := make(TargetSet)
+	for _, pkg := range ListedPkgs {
+		set[pkg] = true
+	}
+	return set.Sorted()
+}
+
+// the imports in deps other than cgo's "C", which isn't a package
+func packageImports(deps []string) (imports []string) {
+	imports = []string{}
+	for _, dep := range deps {
+		if dep != "\"C\"" {
+			imports = append(imports, dep)
+		}
+	}
+	return
+}
+
+// BuiltSrcDeps maps each source file that goes into the package, and with -t
+// each test file, to its imports.
+func (this *Package) BuiltSrcDeps() (srcDeps map[string][]string) {
+	srcDeps = make(map[string][]string)
+	for _, src := range append(append([]string{}, this.PkgSrc[this.Name]...), this.PkgCGoSrc[this.Name]...) {
+		srcDeps[src] = packageImports(this.SrcDeps[src])
+	}
+	if Test {
+		for src, deps := range this.TestSrcDeps {
+			srcDeps[src] = packageImports(deps)
+		}
+	}
+	return
+}
+
+func sortedKeys(m map[string][]string) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.StringSlice(keys).Sort()
+	return
+}
+
+func TryFileGraph() (err os.Error) {
+	if FileGraph == "" {
+		return
+	}
+
+	pkgs := sortedListedPkgs()
+	switch FileGraph {
+	case "text":
+		for _, pkg := range pkgs {
+			fmt.Printf("in %s: %s \"%s\"\n", pkg.Dir, pkg.PkgKind(), pkg.Target)
+			srcDeps := pkg.BuiltSrcDeps()
+			for _, src := range sortedKeys(srcDeps) {
+				fmt.Printf("\t%s: %s\n", src, strings.Join(srcDeps[src], " "))
+			}
+		}
+	case "json":
+		var objs []map[string]interface{}
+		for _, pkg := range pkgs {
+			files := make(map[string][]string)
+			for src, deps := range pkg.BuiltSrcDeps() {
+				imports := []string{}
+				for _, dep := range deps {
+					imports = append(imports, strings.Trim(dep, "\""))
+				}
+				files[src] = imports
+			}
+			objs = append(objs, map[string]interface{}{
+				"target": pkg.Target,
+				"dir":    pkg.Dir,
+				"files":  files,
+			})
+		}
+		if objs == nil {
+			objs = []map[string]interface{}{}
+		}
+		var out []byte
+		if out, err = json.MarshalIndent(objs, "", "\t"); err != nil {
+			return
+		}
+		fmt.Println(string(out))
+	case "dot":
+		fmt.Println("digraph imports {")
+		for _, pkg := range pkgs {
+			srcDeps := pkg.BuiltSrcDeps()
+			srcs := sortedKeys(srcDeps)
+			fmt.Printf("\tsubgraph %q {\n\t\tlabel=%q;\n", "cluster_"+pkg.Dir, pkg.Target)
+			for _, src := range srcs {
+				fmt.Printf("\t\t%q;\n", path.Join(pkg.Dir, src))
+			}
+			fmt.Println("\t}")
+			for _, src := range srcs {
+				for _, dep := range srcDeps[src] {
+					fmt.Printf("\t%q -> %s;\n", path.Join(pkg.Dir, src), dep)
+				}
+			}
+		}
+		fmt.Println("}")
+	}
+	return
+}
+
+// SingleUseImports maps the imports that exactly one of the package's files
+// makes to that file, for packages of more than one file.
+func (this *Package) SingleUseImports() (single map[string]string) {
+	single = make(map[string]string)
+	srcDeps := this.BuiltSrcDeps()
+	if len(srcDeps) < 2 {
+		return
+	}
+	count := make(map[string]int)
+	for src, deps := range srcDeps {
+		for _, dep := range RemoveDups(deps) {
+			count[dep]++
+			single[dep] = src
+		}
+	}
+	for dep, n := range count {
+		if n != 1 {
+			single[dep] = "", false
+		}
+	}
+	return
+}
+
+func TrySingleUse() {
+	if !SingleUse {
+		return
+	}
+	for _, pkg := range sortedListedPkgs() {
+		single := pkg.SingleUseImports()
+		if len(single) == 0 {
+			continue
+		}
+		var deps []string
+		for dep := range single {
+			deps = append(deps, dep)
+		}
+		sort.StringSlice(deps).Sort()
+		fmt.Printf("in %s: %s \"%s\"\n", pkg.Dir, pkg.PkgKind(), pkg.Target)
+		for _, dep := range deps {
+			fmt.Printf("\t%s only in %s\n", dep, single[dep])
+		}
+	}
+}
+
+// --unreachable lists the workspace packages that no cmd imports, directly
+// or not, nor with -t any test
+var Unreachable bool
+
+// UnreachableTargets finds the workspace packages that nothing in roots
+// imports, directly or not.
+func UnreachableTargets(withTests bool) (dead TargetSet) {
+	roots := make(TargetSet)
+	for pkg := range AllTargets() {
+		if pkg.PkgLocation() != "workspace" {
+			continue
+		}
+		if pkg.IsCmd {
+			roots[pkg] = true
+		}
+		if withTests {
+			for _, dp := range pkg.TestDepPkgs {
+				roots[dp] = true
+			}
+		}
+	}
+	live := roots.Deps(false)
+	for pkg := range roots {
+		live[pkg] = true
+	}
+
+	dead = AllTargets().Filter(func(pkg *Package) bool {
+		return !pkg.IsCmd && pkg.PkgLocation() == "workspace" && !live[pkg]
+	})
+	return
+}
+
+// SourceLines counts the lines in the package's source files.
+func (this *Package) SourceLines() (lines int) {
+	for _, src := range this.Sources {
+		if data, err := ioutil.ReadFile(path.Join(this.Dir, src)); err == nil {
+			lines += bytes.Count(data, []byte{'\n'})
+		}
+	}
+	return
+}
+
+func TryUnreachable() {
+	if !Unreachable {
+		return
+	}
+	total := 0
+	dead := UnreachableTargets(Test).Sorted()
+	for _, pkg := range dead {
+		lines := pkg.SourceLines()
+		total += lines
+		fmt.Printf("in %s: %s \"%s\" (%d lines)\n", pkg.Dir, pkg.PkgKind(), pkg.Target, lines)
+	}
+	if len(dead) == 1 {
+		fmt.Printf("1 unreachable target, %d lines\n", total)
+	} else {
+		fmt.Printf("%d unreachable targets, %d lines\n", len(dead), total)
+	}
+}
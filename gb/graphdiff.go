@@ -0,0 +1,291 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// --graphdiff=REV1..REV2 prints how the target graph changed between two git
+// revisions; without "..REV2", between REV1 and the working tree
+var GraphDiff string
+
+// a scan of the workspace's own targets, keyed like Packages
+type GraphSnapshot map[string]*Package
+
+func SnapshotPackages() (snap GraphSnapshot) {
+	snap = make(GraphSnapshot)
+	for key, pkg := range Packages {
+		if loc := pkg.PkgLocation(); loc == "workspace" || loc == "vendor" {
+			snap[key] = pkg
+		}
+	}
+	return
+}
+
+// GitToplevel finds the root of the git checkout the workspace is in, and
+// the workspace's path within it.
+func GitToplevel() (top, prefix string, err os.Error) {
+	if top, err = RunExternalOutput(CWD, []string{"git", "rev-parse", "--show-toplevel"}); err != nil {
+		return
+	}
+	top = strings.TrimSpace(top)
+	if prefix, err = RunExternalOutput(CWD, []string{"git", "rev-parse", "--show-prefix"}); err != nil {
+		return
+	}
+	prefix = strings.TrimSpace(prefix)
+	return
+}
+
+// SnapshotRevision scans the workspace as it was at rev, in a temporary git
+// worktree, which unlike an exported copy keeps what -u names targets by.
+func SnapshotRevision(rev string) (snap GraphSnapshot, err os.Error) {
+	var top, prefix string
+	if top, prefix, err = GitToplevel(); err != nil {
+		return
+	}
+
+	var tmp string
+	if tmp, err = ioutil.TempDir("", "gb-graphdiff"); err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	tree := filepath.Join(tmp, "tree")
+	if _, err = RunExternalOutput(top, []string{"git", "worktree", "add", "-q", "--detach", tree, rev}); err != nil {
+		err = os.NewError(fmt.Sprintf("git worktree add %s: %v", rev, err))
+		return
+	}
+	defer RunExternalOutput(top, []string{"git", "worktree", "remove", "--force", tree})
+
+	workspace := filepath.Join(tree, prefix)
+	if !isDir(workspace) {
+		// the workspace didn't exist yet
+		return make(GraphSnapshot), nil
+	}
+
+	err = InWorkspace(workspace, func() os.Error {
+		snap = SnapshotPackages()
+		return nil
+	})
+	if err != nil {
+		err = os.NewError(fmt.Sprintf("at %s: %v", rev, err))
+	}
+	return
+}
+
+// InWorkspace loads the workspace in dir in place of the real one, runs f,
+// and then puts everything back.
+func InWorkspace(dir string, f func() os.Error) (err os.Error) {
+	savedPackages, savedCWD, savedOverrides := Packages, CWD, Overrides
+	savedHosts, savedPolicy, savedLayers := goinstallables, Policy, Layers
+	savedPolicyViolations, savedLayerViolations := PolicyViolations, LayerViolations
+	defer func() {
+		Packages, CWD, Overrides = savedPackages, savedCWD, savedOverrides
+		goinstallables, Policy, Layers = savedHosts, savedPolicy, savedLayers
+		PolicyViolations, LayerViolations = savedPolicyViolations, savedLayerViolations
+		os.Chdir(CWD)
+	}()
+	Packages, CWD, Overrides = make(map[string]*Package), dir, make(map[string]*Package)
+	Policy, Layers = nil, nil
+	if err = os.Chdir(dir); err != nil {
+		return
+	}
+	if err = LoadWorkspace(); err != nil {
+		return
+	}
+	return f()
+}
+
+// Lookup finds the key of the target in snap that an import resolves to,
+// through overrides.gb as LookupImport would.
+func (snap GraphSnapshot) Lookup(dep string) (key string, ok bool) {
+	if _, ok = snap[dep]; ok {
+		return dep, true
+	}
+	for key, pkg := range snap {
+		for _, alias := range pkg.Aliases {
+			if "\""+alias+"\"" == dep {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// the targets in snap that pkg imports, and the imports from outside it and
+// $GOROOT
+func (snap GraphSnapshot) Imports(pkg *Package) (internal, external []string) {
+	for _, dep := range pkg.Deps {
+		if dep == "\"C\"" {
+			continue
+		}
+		if key, ok := snap.Lookup(dep); ok {
+			internal = append(internal, key)
+		} else if !isDir(filepath.Join(GOROOT, "src", "pkg", strings.Trim(dep, "\""))) {
+			external = append(external, dep)
+		}
+	}
+	return
+}
+
+func keyName(key string) string {
+	if strings.HasSuffix(key, "-cmd") {
+		return strings.Trim(key[:len(key)-len("-cmd")], "\"") + " (cmd)"
+	}
+	return strings.Trim(key, "\"")
+}
+
+func sortedSet(set map[string]bool) (list []string) {
+	for s := range set {
+		list = append(list, s)
+	}
+	sort.StringSlice(list).Sort()
+	return
+}
+
+// DiffGraphs describes, one change per line, how the target graph changed
+// from before to after.
+func DiffGraphs(before, after GraphSnapshot) (changes []string) {
+	// a target whose directory now holds a target of another name was renamed
+	renamed := make(map[string]string)
+	newByDir := make(map[string]string)
+	for key, pkg := range after {
+		newByDir[pkg.Dir] = key
+	}
+	for key, pkg := range before {
+		if _, ok := after[key]; ok {
+			continue
+		}
+		if nkey, ok := newByDir[pkg.Dir]; ok {
+			if _, existed := before[nkey]; !existed {
+				renamed[key] = nkey
+			}
+		}
+	}
+	wasRenamed := make(map[string]bool)
+	for _, nkey := range renamed {
+		wasRenamed[nkey] = true
+	}
+
+	var targets []string
+	for key, pkg := range before {
+		if nkey, ok := renamed[key]; ok {
+			targets = append(targets, fmt.Sprintf("~ target \"%s\" renamed \"%s\" (in %s)", keyName(key), keyName(nkey), pkg.Dir))
+		} else if _, ok := after[key]; !ok {
+			targets = append(targets, fmt.Sprintf("- target \"%s\" (in %s)", keyName(key), pkg.Dir))
+		}
+	}
+	for key, pkg := range after {
+		if _, ok := before[key]; !ok && !wasRenamed[key] {
+			targets = append(targets, fmt.Sprintf("+ target \"%s\" (in %s)", keyName(key), pkg.Dir))
+		}
+	}
+	sort.StringSlice(targets).Sort()
+	changes = append(changes, targets...)
+
+	// compare edges by the new names of renamed targets
+	newName := func(key string) string {
+		if nkey, ok := renamed[key]; ok {
+			return nkey
+		}
+		return key
+	}
+	edges := func(snap GraphSnapshot, rename bool) (set, ext map[string]bool) {
+		set, ext = make(map[string]bool), make(map[string]bool)
+		for key, pkg := range snap {
+			internal, external := snap.Imports(pkg)
+			from := key
+			if rename {
+				from = newName(key)
+			}
+			for _, dep := range internal {
+				to := dep
+				if rename {
+					to = newName(dep)
+				}
+				set[fmt.Sprintf("\"%s\" imports \"%s\"", keyName(from), keyName(to))] = true
+			}
+			for _, dep := range external {
+				ext[dep] = true
+			}
+		}
+		return
+	}
+	oldEdges, oldExt := edges(before, true)
+	newEdges, newExt := edges(after, false)
+
+	var edgeChanges []string
+	for _, e := range sortedSet(oldEdges) {
+		if !newEdges[e] {
+			edgeChanges = append(edgeChanges, "- "+e)
+		}
+	}
+	for _, e := range sortedSet(newEdges) {
+		if !oldEdges[e] {
+			edgeChanges = append(edgeChanges, "+ "+e)
+		}
+	}
+	sort.StringSlice(edgeChanges).Sort()
+	changes = append(changes, edgeChanges...)
+
+	for _, dep := range sortedSet(newExt) {
+		if !oldExt[dep] {
+			changes = append(changes, fmt.Sprintf("+ external import %s", dep))
+		}
+	}
+	for _, dep := range sortedSet(oldExt) {
+		if !newExt[dep] {
+			changes = append(changes, fmt.Sprintf("- external import %s", dep))
+		}
+	}
+	return
+}
+
+func TryGraphDiff() (err os.Error) {
+	if GraphDiff == "" {
+		return
+	}
+
+	revs := strings.SplitN(GraphDiff, "..", 2)
+	var before, after GraphSnapshot
+	if before, err = SnapshotRevision(revs[0]); err != nil {
+		return
+	}
+	if len(revs) == 2 && revs[1] != "" {
+		if after, err = SnapshotRevision(revs[1]); err != nil {
+			return
+		}
+	} else {
+		after = SnapshotPackages()
+	}
+
+	changes := DiffGraphs(before, after)
+	if len(changes) == 0 {
+		fmt.Printf("No changes to the target graph\n")
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return
+}
@@ -0,0 +1,92 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+)
+
+// layers.gb declares which workspace targets may not import which, one rule
+// per line, as
+//	deny <importer> <imported>
+// where each side is a target or directory prefix, or "*" for any target,
+// optionally qualified as "cmd:<prefix>" or "pkg:<prefix>".
+var LayersFile = "layers.gb"
+
+type LayerPattern struct {
+	Kind   string // "cmd", "pkg" or "" for either
+	Prefix string
+}
+
+func ParseLayerPattern(s string) (p LayerPattern) {
+	if i := strings.Index(s, ":"); i != -1 && (s[:i] == "cmd" || s[:i] == "pkg") {
+		p.Kind, s = s[:i], s[i+1:]
+	}
+	p.Prefix = strings.TrimRight(strings.Trim(s, "\""), "/")
+	return
+}
+
+func (this LayerPattern) Matches(pkg *Package) bool {
+	if this.Kind == "cmd" && !pkg.IsCmd || this.Kind == "pkg" && pkg.IsCmd {
+		return false
+	}
+	return importHasPrefix(pkg.Target, this.Prefix) || importHasPrefix(pkg.Dir, this.Prefix)
+}
+
+func (this LayerPattern) String() string {
+	if this.Kind != "" {
+		return this.Kind + ":" + this.Prefix
+	}
+	return this.Prefix
+}
+
+type LayerRule struct {
+	From, To LayerPattern
+	Line     int
+}
+
+var Layers []*LayerRule
+
+// the number of imports that ResolveDeps found breaking a layering rule
+var LayerViolations int
+
+func LoadLayers() (err os.Error) {
+	return ReadConfig(LayersFile, func(lineno int, fields []string) os.Error {
+		if len(fields) != 3 || fields[0] != "deny" {
+			return os.NewError(`expected "deny importer imported"`)
+		}
+		Layers = append(Layers, &LayerRule{ParseLayerPattern(fields[1]), ParseLayerPattern(fields[2]), lineno})
+		return nil
+	})
+}
+
+// CheckLayers says whether from may import to, and if not, which rule
+// forbids it.
+func CheckLayers(from, to *Package) (ok bool, why string) {
+	if from == to {
+		return true, ""
+	}
+	for _, rule := range Layers {
+		if rule.From.Matches(from) && rule.To.Matches(to) {
+			why = fmt.Sprintf("%s may not import %s (%s:%d)", rule.From, rule.To, LayersFile, rule.Line)
+			return
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,331 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sort"
+	"bufio"
+	"strings"
+	"path/filepath"
+	"crypto/sha1"
+)
+
+// lock.gb records the exact source used for each remote import
+var LockFile = "lock.gb"
+
+type LockEntry struct {
+	Import, VCS, Revision, Hash string
+}
+
+var lockEntries map[string]*LockEntry
+var lockErr os.Error
+
+// LockedEntry returns what lock.gb says about target, if anything.
+func LockedEntry(target string) (entry *LockEntry, err os.Error) {
+	if lockEntries == nil {
+		lockEntries = make(map[string]*LockEntry)
+		if fin, oerr := os.Open(LockFile); oerr == nil {
+			var entries []*LockEntry
+			entries, lockErr = ParseLock(fin)
+			fin.Close()
+			for _, e := range entries {
+				lockEntries[e.Import] = e
+			}
+		}
+	}
+	return lockEntries[target], lockErr
+}
+
+func ParseLock(r io.Reader) (entries []*LockEntry, err os.Error) {
+	br := bufio.NewReader(r)
+	for lineno := 1; ; lineno++ {
+		var line string
+		line, err = br.ReadString('\n')
+		if err != nil && err != os.EOF {
+			return
+		}
+		eof := err == os.EOF
+		err = nil
+
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				err = os.NewError(fmt.Sprintf("%s:%d: expected \"import vcs revision hash\"", LockFile, lineno))
+				return
+			}
+			entries = append(entries, &LockEntry{fields[0], fields[1], fields[2], fields[3]})
+		}
+
+		if eof {
+			break
+		}
+	}
+	return
+}
+
+func WriteLock(w io.Writer, entries []*LockEntry) (err os.Error) {
+	_, err = fmt.Fprintf(w, "# Lock file generated by gb: http://go-gb.googlecode.com\n# import vcs revision hash\n")
+	for _, e := range entries {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "%s %s %s %s\n", e.Import, e.VCS, e.Revision, e.Hash)
+	}
+	return
+}
+
+// HashDir hashes the names and contents of the regular, non-hidden files in
+// dir, which is everything CopyDir would vendor.
+func HashDir(dir string) (sum string, err os.Error) {
+	var fdir *os.File
+	if fdir, err = os.Open(dir); err != nil {
+		return
+	}
+	infos, err := fdir.Readdir(-1)
+	fdir.Close()
+	if err != nil {
+		return
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.IsRegular() && !strings.HasPrefix(info.Name, ".") {
+			names = append(names, info.Name)
+		}
+	}
+	sort.StringSlice(names).Sort()
+
+	h := sha1.New()
+	for _, name := range names {
+		var fin *os.File
+		if fin, err = os.Open(filepath.Join(dir, name)); err != nil {
+			return
+		}
+		io.WriteString(h, name+"\n")
+		_, err = io.Copy(h, fin)
+		fin.Close()
+		if err != nil {
+			return
+		}
+	}
+	sum = fmt.Sprintf("%x", h.Sum())
+	return
+}
+
+// VCSRevision asks the version control system which revision is checked out
+// in the repository containing the source for target, or returns "-".
+func VCSRevision(vcs, root, target, src string) (rev string) {
+	rev = "-"
+	if !strings.HasSuffix(src, target) {
+		return
+	}
+	repo := filepath.Join(src[:len(src)-len(target)], root)
+
+	var argv []string
+	switch vcs {
+	case "git":
+		argv = []string{"git", "rev-parse", "HEAD"}
+	case "hg":
+		argv = []string{"hg", "log", "-r", ".", "--template", "{node}"}
+	case "svn":
+		argv = []string{"svnversion", "."}
+	case "bzr":
+		argv = []string{"bzr", "revno"}
+	default:
+		return
+	}
+	for _, meta := range []string{".git", ".hg", ".svn", ".bzr"} {
+		if _, err := os.Stat(filepath.Join(repo, meta)); err == nil {
+			out, err := RunExternalOutput(repo, argv)
+			if err == nil && strings.TrimSpace(out) != "" {
+				rev = strings.TrimSpace(out)
+			}
+			return
+		}
+	}
+	return
+}
+
+// RemoteSourceDir finds the source that an import of target would be built
+// from, preferring a vendored or mirrored copy.
+func RemoteSourceDir(target string) (dir string, err os.Error) {
+	if pkg, ok := Packages["\""+target+"\""]; ok && (pkg.IsVendored || pkg.IsMirrored) {
+		dir = pkg.Dir
+		return
+	}
+	dir, err = FindRemoteSource(target)
+	return
+}
+
+// RemoteImports lists every goinstallable import that the listed targets
+// need, directly or through other packages.
+func RemoteImports() (imports []string) {
+	seen := make(map[string]bool)
+	var todo []string
+	want := func(deps []string) {
+		for _, dep := range deps {
+			dep = strings.Trim(dep, "\"")
+			if _, ok := Overrides["\""+dep+"\""]; ok {
+				continue
+			}
+			if IsGoInstallable(dep) && !seen[dep] {
+				seen[dep] = true
+				todo = append(todo, dep)
+			}
+		}
+	}
+
+	visited := make(map[*Package]bool)
+	var visit func(pkg *Package)
+	visit = func(pkg *Package) {
+		if visited[pkg] {
+			return
+		}
+		visited[pkg] = true
+		want(pkg.Deps)
+		if Test {
+			want(pkg.TestDeps)
+		}
+		for _, dp := range pkg.DepPkgs {
+			visit(dp)
+		}
+	}
+	for _, pkg := range ListedPkgs {
+		visit(pkg)
+	}
+
+	for len(todo) != 0 {
+		target := todo[0]
+		todo = todo[1:]
+		imports = append(imports, target)
+		if pkg, ok := Packages["\""+target+"\""]; ok {
+			visit(pkg)
+			continue
+		}
+		if src, err := FindRemoteSource(target); err == nil {
+			want(DirDeps(src))
+		}
+	}
+
+	sort.StringSlice(imports).Sort()
+	return
+}
+
+func LockSource(target string) (entry *LockEntry, err os.Error) {
+	vcs, root, _ := RemoteRepo(target)
+	if vcs == "" {
+		vcs = "-"
+	}
+	entry = &LockEntry{Import: target, VCS: vcs, Revision: "-"}
+
+	var src string
+	if src, err = RemoteSourceDir(target); err != nil {
+		return
+	}
+	if entry.Hash, err = HashDir(src); err != nil {
+		return
+	}
+
+	// the revision of the source that was hashed; vendored copies carry no
+	// history, and what they were copied from may have moved on since
+	if pkg, ok := Packages["\""+target+"\""]; !ok || !pkg.IsVendored {
+		entry.Revision = VCSRevision(vcs, root, target, src)
+	}
+	return
+}
+
+func TryLock() (err os.Error) {
+	if !WriteLockFile {
+		return
+	}
+
+	var entries []*LockEntry
+	for _, target := range RemoteImports() {
+		var entry *LockEntry
+		if entry, err = LockSource(target); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	fmt.Printf("(in .) writing %s\n", LockFile)
+	var fout *os.File
+	if fout, err = os.Create(LockFile); err != nil {
+		return
+	}
+	if err = WriteLock(fout, entries); err != nil {
+		fout.Close()
+		return
+	}
+	err = fout.Close()
+	return
+}
+
+func TryVerifyLock() (err os.Error) {
+	if !VerifyLockFile {
+		return
+	}
+
+	var fin *os.File
+	if fin, err = os.Open(LockFile); err != nil {
+		return
+	}
+	entries, err := ParseLock(fin)
+	fin.Close()
+	if err != nil {
+		return
+	}
+
+	locked := make(map[string]*LockEntry)
+	for _, e := range entries {
+		locked[e.Import] = e
+	}
+
+	mismatches := 0
+	for _, target := range RemoteImports() {
+		e, ok := locked[target]
+		if !ok {
+			ErrLog.Printf("\"%s\" is not in %s\n", target, LockFile)
+			mismatches++
+			continue
+		}
+		current, lerr := LockSource(target)
+		if lerr != nil {
+			ErrLog.Printf("\"%s\": %v\n", target, lerr)
+			mismatches++
+			continue
+		}
+		if current.Hash != e.Hash {
+			ErrLog.Printf("\"%s\": source hash is %s, but %s has %s\n", target, current.Hash, LockFile, e.Hash)
+			mismatches++
+		} else if e.Revision != "-" && current.Revision != "-" && current.Revision != e.Revision {
+			ErrLog.Printf("\"%s\": revision is %s, but %s has %s\n", target, current.Revision, LockFile, e.Revision)
+			mismatches++
+		}
+	}
+
+	if mismatches != 0 {
+		err = os.NewError(fmt.Sprintf("remote packages don't match %s", LockFile))
+	} else if Verbose {
+		fmt.Printf("Remote packages match %s\n", LockFile)
+	}
+	return
+}
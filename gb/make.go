@@ -18,7 +18,11 @@ package main
 
 import (
 	"os"
+	"io"
 	"fmt"
+	"bufio"
+	"strings"
+	"path"
 )
 
 func MakeBuild(pkg *Package) (err os.Error) {
@@ -68,3 +72,174 @@ func MakeTest(pkg *Package) (err os.Error) {
 	err = RunExternal(MakeCMD, pkg.Dir, margs)
 	return
 }
+
+// the parts of a hand-written makefile that gb can understand
+type MakefileInfo struct {
+	Targ     string
+	GoFiles  []string
+	CGoFiles []string
+	OFiles   []string
+	Includes []string
+}
+
+// expandMakeWord substitutes the make variables gb knows the value of, and
+// returns "" for words that still depend on something it doesn't.
+func expandMakeWord(word string) string {
+	o := strings.TrimLeft(GetObjSuffix(), ".")
+	word = strings.Replace(word, "$(GOOS)", GOOS, -1)
+	word = strings.Replace(word, "$(GOARCH)", GOARCH, -1)
+	word = strings.Replace(word, "$(O)", o, -1)
+	word = strings.Replace(word, "$O", o, -1)
+	if strings.Contains(word, "$") {
+		return ""
+	}
+	return word
+}
+
+func ParseMakefile(r io.Reader) (info *MakefileInfo, err os.Error) {
+	info = new(MakefileInfo)
+	br := bufio.NewReader(r)
+
+	var logical string
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if err != nil && err != os.EOF {
+			return
+		}
+		eof := err == os.EOF
+		err = nil
+
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasSuffix(line, "\\") {
+			logical += line[:len(line)-1] + " "
+			if !eof {
+				continue
+			}
+		} else {
+			logical += line
+		}
+		line, logical = logical, ""
+
+		// recipe lines belong to rules, not to variables
+		if !strings.HasPrefix(line, "\t") {
+			if i := strings.Index(line, "#"); i != -1 {
+				line = line[:i]
+			}
+			info.parseLine(strings.TrimSpace(line))
+		}
+
+		if eof {
+			break
+		}
+	}
+	return
+}
+
+func (info *MakefileInfo) parseLine(line string) {
+	if strings.HasPrefix(line, "include ") || strings.HasPrefix(line, "-include ") {
+		for _, inc := range strings.Fields(line)[1:] {
+			info.Includes = append(info.Includes, inc)
+		}
+		return
+	}
+
+	eq := strings.Index(line, "=")
+	if eq == -1 {
+		return
+	}
+	name, value := line[:eq], line[eq+1:]
+	appending := false
+	switch {
+	case strings.HasSuffix(name, "+"):
+		appending = true
+		name = name[:len(name)-1]
+	case strings.HasSuffix(name, ":"), strings.HasSuffix(name, "?"):
+		name = name[:len(name)-1]
+	}
+	name = strings.TrimSpace(name)
+
+	var words []string
+	for _, word := range strings.Fields(value) {
+		if word = expandMakeWord(word); word != "" {
+			words = append(words, word)
+		}
+	}
+
+	var list *[]string
+	switch name {
+	case "TARG":
+		if len(words) != 0 {
+			info.Targ = words[0]
+		}
+		return
+	case "GOFILES":
+		list = &info.GoFiles
+	case "CGOFILES":
+		list = &info.CGoFiles
+	case "OFILES":
+		list = &info.OFiles
+	default:
+		return
+	}
+	if !appending {
+		*list = nil
+	}
+	*list = append(*list, words...)
+}
+
+func ReadMakefile(dir string) (info *MakefileInfo, err os.Error) {
+	var fin *os.File
+	fin, err = os.Open(path.Join(dir, "Makefile"))
+	if err != nil {
+		fin, err = os.Open(path.Join(dir, "makefile"))
+	}
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+	info, err = ParseMakefile(fin)
+	return
+}
+
+// ReconcileMakefile warns about files that gb and the package's hand-written
+// makefile disagree on.
+func (this *Package) ReconcileMakefile() {
+	if this.Makefile == nil {
+		return
+	}
+
+	var asmObjs []string
+	for _, asm := range this.AsmSrcs {
+		asmObjs = append(asmObjs, asm[:len(asm)-2]+GetObjSuffix())
+	}
+
+	compare := func(variable string, mine, theirs []string) {
+		listed := make(map[string]bool)
+		for _, f := range theirs {
+			listed[f] = true
+		}
+		for _, f := range mine {
+			if !listed[f] {
+				ErrLog.Printf("(in %s) %s in the makefile omits %s, which gb would compile\n", this.Dir, variable, f)
+			}
+			listed[f] = false
+		}
+		for _, f := range theirs {
+			if listed[f] {
+				ErrLog.Printf("(in %s) %s in the makefile lists %s, which gb would not compile\n", this.Dir, variable, f)
+			}
+		}
+	}
+	compare("GOFILES", this.PkgSrc[this.Name], this.Makefile.GoFiles)
+	compare("CGOFILES", this.PkgCGoSrc[this.Name], this.Makefile.CGoFiles)
+	compare("OFILES", asmObjs, this.Makefile.OFiles)
+
+	targ := this.Target
+	if this.IsCmd && GOOS == "windows" && strings.HasSuffix(targ, ".exe") {
+		targ = targ[:len(targ)-len(".exe")]
+	}
+	if this.Makefile.Targ != "" && this.Makefile.Targ != targ {
+		ErrLog.Printf("(in %s) TARG in the makefile is %s, but the target is \"%s\"\n", this.Dir, this.Makefile.Targ, this.Target)
+	}
+}
@@ -0,0 +1,170 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"exec"
+	"fmt"
+	"strings"
+	"path/filepath"
+)
+
+// $GB_MIRROR, a directory of repositories or source trees laid out by import path
+var MirrorDir string
+
+// where remote packages from the mirror are checked out and built as targets
+var MirrorWorkDir = "_mirror_"
+
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDirectory()
+}
+
+// the repository roots fetched from the mirror during this run
+var mirrorFetched = make(map[string]bool)
+
+// MirrorFetch checks out the repository holding target from the mirror,
+// unless that has already been done, and returns the package's directory.
+func MirrorFetch(target string) (dir string, err os.Error) {
+	target = strings.Trim(target, "\"")
+	_, root, ok := RemoteRepo(target)
+	if !ok {
+		err = os.NewError(fmt.Sprintf("\"%s\" is not a remote package", target))
+		return
+	}
+
+	dir = filepath.Join(MirrorWorkDir, target)
+	work := filepath.Join(MirrorWorkDir, root)
+	if isDir(work) && (!GoInstallUpdate || mirrorFetched[root]) {
+		return
+	}
+	defer func() {
+		if err == nil {
+			mirrorFetched[root] = true
+		}
+	}()
+
+	src := filepath.Join(MirrorDir, root)
+	if !isDir(src) && isDir(src+".git") {
+		src += ".git"
+	}
+	if !isDir(src) {
+		err = os.NewError(fmt.Sprintf("\"%s\" is not in the mirror at %s", root, MirrorDir))
+		return
+	}
+
+	if err = os.RemoveAll(work); err != nil {
+		return
+	}
+	parent, _ := filepath.Split(work)
+	if err = os.MkdirAll(parent, 0755); err != nil {
+		return
+	}
+
+	var rev string
+	var e *LockEntry
+	if e, err = LockedEntry(target); err != nil {
+		return
+	}
+	if e != nil && e.Revision != "-" {
+		rev = e.Revision
+	}
+
+	var argv, checkout []string
+	switch {
+	case isDir(filepath.Join(src, ".git")) || isDir(filepath.Join(src, "objects")):
+		argv = []string{"git", "clone", "-q", src, work}
+		if rev != "" {
+			checkout = []string{"git", "checkout", "-q", rev}
+		}
+	case isDir(filepath.Join(src, ".hg")):
+		argv = []string{"hg", "clone", "-q", src, work}
+		if rev != "" {
+			checkout = []string{"hg", "update", "-q", "-r", rev}
+		}
+	}
+
+	fmt.Printf("Fetching \"%s\" from %s\n", root, src)
+	if argv == nil {
+		// a plain source tree
+		err = CopyTree(src, work)
+		return
+	}
+	var cmd string
+	if cmd, err = exec.LookPath(argv[0]); err != nil {
+		return
+	}
+	if Verbose {
+		fmt.Printf("%v\n", argv)
+	}
+	if err = RunExternal(cmd, ".", argv); err != nil {
+		return
+	}
+	if checkout != nil {
+		if Verbose {
+			fmt.Printf("(in %s) %v\n", work, checkout)
+		}
+		err = RunExternal(cmd, work, checkout)
+	}
+	return
+}
+
+// ScanMirror makes targets out of the remote packages the workspace imports,
+// fetching them from the mirror instead of asking goinstall for them.
+func ScanMirror() (err os.Error) {
+	if MirrorDir == "" {
+		return
+	}
+
+	var todo []*Package
+	for _, pkg := range Packages {
+		todo = append(todo, pkg)
+	}
+
+	failed := make(map[string]bool)
+	for len(todo) != 0 {
+		pkg := todo[0]
+		todo = todo[1:]
+
+		deps := pkg.Deps
+		if Test {
+			deps = append(append([]string{}, deps...), pkg.TestDeps...)
+		}
+		for _, dep := range deps {
+			if _, ok := LookupImport(dep); ok || failed[dep] || !IsGoInstallable(dep) {
+				continue
+			}
+			target := strings.Trim(dep, "\"")
+			dir, ferr := MirrorFetch(target)
+			if ferr != nil {
+				ErrLog.Printf("(in %s) %v\n", pkg.Dir, ferr)
+				failed[dep] = true
+				continue
+			}
+			mpkg, perr := NewPackage(target, dir)
+			if perr != nil {
+				ErrLog.Printf("(in %s) %v\n", dir, perr)
+				failed[dep] = true
+				continue
+			}
+			Packages[dep] = mpkg
+			todo = append(todo, mpkg)
+		}
+	}
+	return
+}
@@ -0,0 +1,96 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"path"
+)
+
+// overrides.gb maps import paths to workspace directories, one per line, as
+//	<import path> <dir>
+// so that a patched copy of a remote package is used wherever it's imported.
+var OverridesFile = "overrides.gb"
+
+// the packages that stand in for overridden imports, keyed like Packages
+var Overrides = make(map[string]*Package)
+
+func LoadOverrides() (err os.Error) {
+	return ReadConfig(OverridesFile, func(lineno int, fields []string) os.Error {
+		if len(fields) != 2 {
+			return os.NewError(`expected "importpath dir"`)
+		}
+		return Override(fields[0], fields[1])
+	})
+}
+
+// Override makes imports of target resolve to the package in dir.
+func Override(target, dir string) (err os.Error) {
+	target = strings.Trim(target, "\"")
+	dir = path.Clean(dir)
+
+	var pkg *Package
+	for _, p := range Packages {
+		if p.Dir == dir && !p.IsCmd {
+			pkg = p
+			break
+		}
+	}
+	if pkg == nil {
+		err = os.NewError(fmt.Sprintf("no package in %s to stand in for \"%s\"", dir, target))
+		return
+	}
+	if pkg.Target == target {
+		return
+	}
+
+	key := "\"" + target + "\""
+	if replaced, ok := Packages[key]; ok && replaced != pkg {
+		// a vendored, mirrored or GOPATH copy of the original
+		replaced.Active = false
+	}
+	Overrides[key] = pkg
+	pkg.Aliases = append(pkg.Aliases, target)
+	return
+}
+
+// LookupImport finds the package that an import, quoted, resolves to.
+func LookupImport(dep string) (pkg *Package, ok bool) {
+	if pkg, ok = Overrides[dep]; ok {
+		return
+	}
+	pkg, ok = Packages[dep]
+	return
+}
+
+// CopyAliases puts a copy of the built package at each overridden import
+// path under dir, so the compiler finds it there.
+func (this *Package) CopyAliases(dir string) (err os.Error) {
+	for _, alias := range this.Aliases {
+		dst := path.Join(dir, alias+".a")
+		adir, _ := path.Split(dst)
+		if err = RunMkdirAll(adir); err != nil {
+			return
+		}
+		if err = Copy(".", this.ResultPath, dst); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"os"
 	"bufio"
+	"bytes"
+	"io/ioutil"
 	"strings"
 	"path"
 	"path/filepath"
@@ -39,9 +41,11 @@ type Package struct {
 	IsCGo bool
 
 	//these prevent multipath issues for tree following
-	built, cleaned, addedToBuild, gofmted, scanned bool
+	built, cleaned, addedToBuild, gofmted, scanned, explained bool
 
 	NeedsBuild, NeedsInstall, NeedsGoInstall bool
+	Unresolved                               []string // imports that ResolveDeps couldn't find
+	ForcedBy                                 string // why NeedsBuild was set regardless of times
 
 	GoSources  []string
 	CGoSources []string
@@ -57,7 +61,8 @@ type Package struct {
 	TestSrc   map[string][]string
 	PkgCGoSrc map[string][]string
 
-	SrcDeps map[string][]string
+	SrcDeps     map[string][]string
+	TestSrcDeps map[string][]string
 	Deps    []string
 	DepPkgs []*Package
 
@@ -71,8 +76,14 @@ type Package struct {
 
 	HasMakefile     bool
 	MustUseMakefile bool
+	Makefile        *MakefileInfo // what gb understood of a hand-written makefile, with -m
+
+	GeneratedMakefile, StaleMakefile bool
 	IsInGOROOT      bool
 	IsInGOPATH      string
+	IsVendored      bool
+	IsMirrored      bool
+	Aliases         []string // import paths this package stands in for, from overrides.gb
 
 	SourceTime, BinTime, InstTime, GOROOTPkgTime int64
 
@@ -110,6 +121,13 @@ func NewPackage(base, dir string) (this *Package, err os.Error) {
 		}
 	}
 
+	if !this.IsInGOROOT && this.IsInGOPATH == "" && HasPathPrefix(this.Dir, VendorDir) {
+		this.IsVendored = true
+	}
+	if !this.IsInGOROOT && this.IsInGOPATH == "" && HasPathPrefix(this.Dir, MirrorWorkDir) {
+		this.IsMirrored = true
+	}
+
 	err = this.ScanForSource()
 	if err != nil {
 		return
@@ -135,6 +153,17 @@ func NewPackage(base, dir string) (this *Package, err os.Error) {
 		this.HasMakefile = true
 	}
 
+	if this.HasMakefile && Makefiles && !this.IsInGOROOT && this.IsInGOPATH == "" {
+		if info, err2 := ReadMakefile(this.Dir); err2 == nil {
+			this.Makefile = info
+			if this.Target == "" {
+				this.Target = info.Targ
+			}
+		} else {
+			ErrLog.Printf("(in %s) could not read makefile: %v\n", this.Dir, err2)
+		}
+	}
+
 	if !this.HasMakefile && this.IsInGOROOT {
 		err = os.NewError("GOROOT pkg without makefile - not meant to be built")
 		return
@@ -175,44 +204,9 @@ func NewPackage(base, dir string) (this *Package, err os.Error) {
 		return
 	}
 
-	this.Active = (DoCmds && this.IsCmd) || (DoPkgs && !this.IsCmd)
-
-	return
-}
+	this.ReconcileMakefile()
 
-func (this *Package) DetectCycles() (cycle []*Package) {
-	cycle = this.detectCycle(nil)
-	return
-}
-
-func (this *Package) detectCycle(visited []*Package) (cycle []*Package) {
-	for i, p := range visited {
-		if p == this {
-			cycle = visited[:i+1]
-			return
-		}
-	}
-
-	visited = append([]*Package{this}, visited...)
-
-	for _, pkg := range this.DepPkgs {
-		cycle = pkg.detectCycle(visited)
-		if cycle != nil {
-			return
-		}
-	}
-
-	if Test {
-		for _, pkg := range this.TestDepPkgs {
-			if pkg == this {
-				continue
-			}
-			cycle = pkg.detectCycle(visited)
-			if cycle != nil {
-				return
-			}
-		}
-	}
+	this.Active = (DoCmds && this.IsCmd) || (DoPkgs && !this.IsCmd)
 
 	return
 }
@@ -395,7 +389,9 @@ func (this *Package) GetSourceDeps() (err os.Error) {
 
 	this.Deps = RemoveDups(this.Deps)
 
-	if Test {
+	// generated makefiles need to know about test dependencies too
+	if Test || ScanTestDeps {
+		this.TestSrcDeps = make(map[string][]string)
 		for _, src := range this.TestSources {
 			var fpkg, ftarget string
 			var fdeps, ffuncs []string
@@ -430,6 +426,7 @@ func (this *Package) GetSourceDeps() (err os.Error) {
 				this.Target = ftarget
 			}
 			//this.Name = fpkg
+			this.TestSrcDeps[src] = fdeps
 			this.TestDeps = append(this.TestDeps, fdeps...)
 			//this.Funcs = append(this.Funcs, ffuncs...)
 			this.TestFuncs[fpkg] = append(this.TestFuncs[fpkg], ffuncs...)
@@ -487,6 +484,11 @@ func (this *Package) GetTarget() (err os.Error) {
 				if this.Base == this.Dir && HasPathPrefix(this.Dir, "pkg") && this.Dir != "pkg" {
 					this.Target = GetRelative("pkg", this.Dir, CWD)
 				}
+				if VCSTargets && this.Base == this.Dir {
+					if vt := VCSTarget(this.Dir); vt != "" {
+						this.Target = vt
+					}
+				}
 			}
 		} else {
 			this.Base = this.Target
@@ -568,6 +570,9 @@ func (this *Package) PrintScan() {
 	if !this.NeedsInstall {
 		bis = " (installed)"
 	}
+	if this.StaleMakefile {
+		bis += " (stale Makefile)"
+	}
 	var label string
 
 	if this.IsCmd {
@@ -582,6 +587,10 @@ func (this *Package) PrintScan() {
 		label = "goroot " + label
 	} else if this.IsInGOPATH != "" {
 		label = "gopath " + label
+	} else if this.IsVendored {
+		label = "vendored " + label
+	} else if this.IsMirrored {
+		label = "mirror " + label
 	}
 
 	displayDir := this.Dir
@@ -598,6 +607,11 @@ func (this *Package) PrintScan() {
 		if Test {
 			fmt.Printf(" %s TestDeps: %v\n", this.Name, this.TestDeps)
 		}
+		for _, dep := range this.Deps {
+			if opkg, ok := Overrides[dep]; ok {
+				fmt.Printf(" %s -> %s (override)\n", dep, opkg.Dir)
+			}
+		}
 	}
 	if ScanListFiles {
 		this.ListSource()
@@ -629,6 +643,38 @@ func (this *Package) CheckStatus() {
 	this.NeedsInstall = i || this.NeedsInstall
 }
 
+func firstImporter(srcDeps map[string][]string, dep string) (src string) {
+	var srcs []string
+	for src := range srcDeps {
+		srcs = append(srcs, src)
+	}
+	sort.StringSlice(srcs).Sort()
+	for _, src := range srcs {
+		for _, sdep := range srcDeps[src] {
+			if sdep == dep {
+				return src
+			}
+		}
+	}
+	return ""
+}
+
+// ImportingFile names the first source file, in order, that imports dep.
+func (this *Package) ImportingFile(dep string) (file string) {
+	if src := firstImporter(this.SrcDeps, dep); src != "" {
+		return path.Join(this.Dir, src)
+	}
+	return this.TestImportingFile(dep)
+}
+
+// TestImportingFile names the first test source file that imports dep.
+func (this *Package) TestImportingFile(dep string) (file string) {
+	if src := firstImporter(this.TestSrcDeps, dep); src != "" {
+		return path.Join(this.Dir, src)
+	}
+	return this.Dir
+}
+
 func (this *Package) ResolveDeps() (err os.Error) {
 	CheckDeps := func(deps []string, test bool) (err os.Error) {
 		for _, dep := range deps {
@@ -636,13 +682,33 @@ func (this *Package) ResolveDeps() (err os.Error) {
 				this.IsCGo = true
 				continue
 			}
-			if pkg, ok := Packages[dep]; ok {
+			if !this.IsInGOROOT && IsExternalImport(dep) {
+				if ok, why := CheckPolicy(dep); !ok {
+					ErrLog.Printf("%s: import %s %s\n", this.ImportingFile(dep), dep, why)
+					PolicyViolations++
+				}
+			}
+			if pkg, ok := LookupImport(dep); ok {
+				if !this.IsInGOROOT && this.IsInGOPATH == "" {
+					if ok, why := CheckLayers(this, pkg); !ok {
+						ErrLog.Printf("%s: import %s: %s\n", this.ImportingFile(dep), dep, why)
+						LayerViolations++
+						continue
+					}
+				}
 				if test {
 					this.TestDepPkgs = append(this.TestDepPkgs, pkg)
 				} else {
 					this.DepPkgs = append(this.DepPkgs, pkg)
 				}
 			} else {
+				if cmd, ok := Packages[dep+"-cmd"]; ok && !this.IsInGOROOT && this.IsInGOPATH == "" {
+					if ok, why := CheckLayers(this, cmd); !ok {
+						ErrLog.Printf("%s: import %s of a cmd: %s\n", this.ImportingFile(dep), dep, why)
+						LayerViolations++
+						continue
+					}
+				}
 				exists, when := PkgExistsInGOROOT(dep)
 				if exists {
 					if this.GOROOTPkgTime < when {
@@ -651,20 +717,22 @@ func (this *Package) ResolveDeps() (err os.Error) {
 				}
 				if !IsGoInstallable(dep) {
 					if !exists {
-						//fmt.Printf("in %s: can't resolve pkg %s (maybe you aren't in the root?)\n", this.Dir, dep)
+						this.Unresolved = append(this.Unresolved, dep)
 						err = os.NewError("unresolved packages")
 					}
 				} else {
 					if GoInstallUpdate {
 						this.NeedsBuild = true
+						this.ForcedBy = fmt.Sprintf("-G updates the remote import %s", dep)
 					}
 					if !exists {
 						if !GoInstall {
-							//fmt.Printf("in %s: can't resolve pkg %s (try using -g)\n", this.Dir, dep)
+							this.Unresolved = append(this.Unresolved, dep)
 							err = os.NewError("unresolved packages")
 						} else {
 							this.NeedsGoInstall = true
 							this.NeedsBuild = true
+							this.ForcedBy = fmt.Sprintf("the remote import %s has yet to be goinstalled", dep)
 						}
 					}
 
@@ -673,11 +741,11 @@ func (this *Package) ResolveDeps() (err os.Error) {
 		}
 		return
 	}
+	// a test import that can't be found is worth reporting too
 	err = CheckDeps(this.Deps, false)
-	if err != nil {
-		return
+	if terr := CheckDeps(this.TestDeps, true); err == nil {
+		err = terr
 	}
-	err = CheckDeps(this.TestDeps, true)
 	return
 }
 
@@ -773,7 +841,7 @@ func (this *Package) Build() (err os.Error) {
 	}
 	if GoInstall {
 		for _, dep := range this.Deps {
-			if _, ok := Packages[dep]; !ok {
+			if _, ok := LookupImport(dep); !ok {
 				goinstTime := GoInstallPkg(dep)
 				if goinstTime > inTime {
 					inTime = goinstTime
@@ -800,6 +868,9 @@ func (this *Package) Build() (err os.Error) {
 			labelDir = "$GOROOT" + labelDir[len(GOROOT):]
 		}
 		fmt.Printf("(in %s) building %s \"%s\"\n", labelDir, which, this.Target)
+		if ScriptFile != nil {
+			ScriptLine("echo %s", ShellQuote(fmt.Sprintf("(in %s) building %s \"%s\"", labelDir, which, this.Target)))
+		}
 
 		if (Makefiles || this.MustUseMakefile) && this.HasMakefile {
 			err = MakeBuild(this)
@@ -809,6 +880,10 @@ func (this *Package) Build() (err os.Error) {
 			err = BuildPackage(this)
 		}
 
+		if err == nil {
+			err = this.CopyAliases(GetBuildDirPkg())
+		}
+
 		if err == nil {
 			PackagesBuilt++
 		} else {
@@ -839,7 +914,7 @@ func (this *Package) Test() (err os.Error) {
 	}
 	if GoInstall {
 		for _, dep := range this.TestDeps {
-			if _, ok := Packages[dep]; !ok {
+			if _, ok := LookupImport(dep); !ok {
 				GoInstallPkg(dep)
 			}
 		}
@@ -960,6 +1035,9 @@ func main() {
 */
 
 func (this *Package) CleanFiles() (err os.Error) {
+	if !this.InScope() {
+		return
+	}
 	defer func() {
 		this.Stat()
 		this.NeedsBuild = true
@@ -1053,6 +1131,13 @@ func (this *Package) CleanFiles() (err os.Error) {
 	return
 }
 
+// InScope says whether gb should clean or install this package. $GOPATH
+// packages that the workspace imports are rebuilt in place when stale, but
+// are otherwise left alone unless gb is run from that $GOPATH, or with -R.
+func (this *Package) InScope() bool {
+	return this.IsInGOPATH == "" || RunningInGOPATH != "" || BuildGOROOT
+}
+
 func (this *Package) Clean() (err os.Error) {
 	if this.cleaned {
 		return
@@ -1066,7 +1151,7 @@ func (this *Package) Clean() (err os.Error) {
 		pkg.Clean()
 	}
 
-	if !this.Active {
+	if !this.Active || !this.InScope() {
 		return
 	}
 
@@ -1088,12 +1173,15 @@ func (this *Package) Install() (err os.Error) {
 		pkg.Install()
 	}
 
-	if !this.Active {
+	if !this.Active || !this.InScope() {
 		return
 	}
 
 	if !(Makefiles && this.HasMakefile) && this.InstTime < this.BinTime && !this.IsInGOROOT {
 		err = InstallPackage(this)
+		if err == nil {
+			err = this.CopyAliases(GetInstallDirPkg())
+		}
 
 		this.Stat()
 
@@ -1208,17 +1296,82 @@ func (this *Package) GenerateMakefile() (err os.Error) {
 	}
 	fmt.Printf("(in %s) generating makefile for %s \"%s\"\n", this.Dir, which, this.Target)
 
+	err = this.WriteMakefile()
+
+	return
+}
+
+func (this *Package) WriteMakefile() (err os.Error) {
+	var text []byte
+	text, err = this.MakefileText()
+	if err != nil {
+		return
+	}
+
 	var file *os.File
-	file, err = os.Create(mpath)
+	file, err = os.Create(path.Join(this.Dir, "Makefile"))
+	if err != nil {
+		return
+	}
 
+	_, err = file.Write(text)
 	if err != nil {
 		return
 	}
 
+	err = file.Close()
+
+	return
+}
+
+// MakefileText renders the makefile that -M would write for this target.
+func (this *Package) MakefileText() (text []byte, err os.Error) {
+	if err = LoadTemplates(); err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	data := this.MakeData()
+
+	if !this.IsCmd {
+		err = MakePkgTemplate.Execute(&buf, data)
+	} else {
+		err = MakeCmdTemplate.Execute(&buf, data)
+	}
+	text = buf.Bytes()
+
+	return
+}
+
+// CheckMakefile notices when a makefile that gb generated no longer matches
+// what gb would generate now.
+func (this *Package) CheckMakefile() {
+	if !this.HasMakefile || this.IsInGOROOT || this.IsInGOPATH != "" {
+		return
+	}
+	current, err := ioutil.ReadFile(path.Join(this.Dir, "Makefile"))
+	if err != nil {
+		return
+	}
+	this.GeneratedMakefile = bytes.HasPrefix(current, []byte(GeneratedMakefileHeader))
+	if !this.GeneratedMakefile {
+		return
+	}
+	text, err := this.MakefileText()
+	if err != nil {
+		ErrLog.Printf("(in %s) %v\n", this.Dir, err)
+		return
+	}
+	this.StaleMakefile = !bytes.Equal(current, text)
+}
+
+func (this *Package) MakeData() (data MakeData) {
 	reverseDots := ReverseDir(this.Dir)
 
-	data := MakeData{
+	data = MakeData{
+		Dir:         this.Dir,
 		Target:      this.Target,
+		IsCmd:       this.IsCmd,
 		GBROOT:      reverseDots,
 		GoFiles:     this.PkgSrc[this.Name],
 		CopyLocal:   reverseDots != ".",
@@ -1226,8 +1379,20 @@ func (this *Package) GenerateMakefile() (err os.Error) {
 		BuildDirCmd: GetBuildDirCmd(),
 		GOPATHS:     GOPATHS,
 	}
+	if GOPATH_INSTALL != "" {
+		if this.IsCmd {
+			data.InstallDir = GetInstallDirCmd()
+		} else {
+			data.InstallDir = GetInstallDirPkg()
+		}
+	}
+	for _, dep := range this.Deps {
+		data.Deps = append(data.Deps, strings.Trim(dep, "\""))
+	}
+	isDep := make(map[*Package]bool)
 	for _, dep := range this.DepPkgs {
 		data.LocalDeps = append(data.LocalDeps, dep.Target)
+		isDep[dep] = true
 	}
 	for _, asm := range this.AsmSrcs {
 		base := asm[0 : len(asm)-2] // definitely ends with '.s', so this is safe
@@ -1244,21 +1409,23 @@ func (this *Package) GenerateMakefile() (err os.Error) {
 					data.CObjs = append(data.CObjs, obj)
 				}
 			}
+			data.CGoCFlags = this.CGoCFlags[this.Name]
+			data.CGoLDFlags = this.CGoLDFlags[this.Name]
+		}
+		data.TestSources = this.TestSources
+		for _, dep := range this.TestDepPkgs {
+			if dep == this || isDep[dep] {
+				continue
+			}
+			isDep[dep] = true
+			data.LocalTestDeps = append(data.LocalTestDeps, dep.Target)
 		}
-		err = MakePkgTemplateExp.Execute(file, data)
 	} else {
 		if GOOS == "windows" && strings.HasSuffix(data.Target, ".exe") {
 			data.Target = data.Target[0 : len(data.Target)-len(".exe")]
 		}
-		err = MakeCmdTemplateExp.Execute(file, data)
-	}
-	
-	if err != nil {
-		return
 	}
 
-	err = file.Close()
-
 	return
 }
 
@@ -1270,7 +1437,7 @@ func (this *Package) CollectGoInstall(gm map[string]bool) {
 	}
 }
 
-func (this *Package) AddToBuild(bfile *os.File) (err os.Error) {
+func (this *Package) AddToBuild(data *BuildData) {
 	if this.addedToBuild {
 		return
 	}
@@ -1285,13 +1452,9 @@ func (this *Package) AddToBuild(bfile *os.File) (err os.Error) {
 	}
 
 	for _, pkg := range this.DepPkgs {
-		err = pkg.AddToBuild(bfile)
-		if err != nil {
-			return
-		}
+		pkg.AddToBuild(data)
 	}
-	_, err = fmt.Fprintf(bfile, "&& echo \"(in %s)\" && cd %s && make $1 && cd - > /dev/null \\\n", this.Dir, this.Dir)
-	return
+	data.Targets = append(data.Targets, this.MakeData())
 }
 
 func (this *Package) GoFMT() (err os.Error) {
@@ -0,0 +1,148 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"strings"
+	"path/filepath"
+)
+
+// policy.gb says which imports from outside the workspace and $GOROOT are
+// allowed, one rule per line, as
+//	allow <import path prefix>
+//	deny <import path prefix>
+// The longest matching prefix decides. An import that matches no rule is
+// allowed only if there are no allow rules.
+var PolicyFile = "policy.gb"
+
+type PolicyRule struct {
+	Allow  bool
+	Prefix string
+	Line   int
+}
+
+var Policy []*PolicyRule
+
+// the number of imports that ResolveDeps found the policy doesn't allow
+var PolicyViolations int
+
+func LoadPolicy() (err os.Error) {
+	return ReadConfig(PolicyFile, func(lineno int, fields []string) os.Error {
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return os.NewError(`expected "allow prefix" or "deny prefix"`)
+		}
+		prefix := strings.TrimRight(strings.Trim(fields[1], "\""), "/")
+		Policy = append(Policy, &PolicyRule{fields[0] == "allow", prefix, lineno})
+		return nil
+	})
+}
+
+func importHasPrefix(target, prefix string) bool {
+	return prefix == "*" || target == prefix || strings.HasPrefix(target, prefix+"/")
+}
+
+// CheckPolicy says whether the policy lets the workspace import dep, and if
+// not, why.
+func CheckPolicy(dep string) (ok bool, why string) {
+	target := strings.Trim(dep, "\"")
+
+	var rule *PolicyRule
+	haveAllows := false
+	for _, r := range Policy {
+		haveAllows = haveAllows || r.Allow
+		if !importHasPrefix(target, r.Prefix) {
+			continue
+		}
+		if rule == nil || len(r.Prefix) > len(rule.Prefix) || rule.Prefix == "*" {
+			rule = r
+		}
+	}
+
+	switch {
+	case rule != nil && rule.Allow:
+		ok = true
+	case rule != nil:
+		why = fmt.Sprintf("is denied by %s:%d", PolicyFile, rule.Line)
+	case haveAllows:
+		why = fmt.Sprintf("is not allowed by %s", PolicyFile)
+	default:
+		ok = true
+	}
+	return
+}
+
+// IsExternalImport says whether dep comes from neither the workspace's own
+// targets nor $GOROOT. Vendored, mirrored and $GOPATH packages are all
+// external, and an overridden import is whatever it was pointed at.
+func IsExternalImport(dep string) bool {
+	if pkg, ok := LookupImport(dep); ok {
+		if pkg.IsInGOROOT {
+			return false
+		}
+		return pkg.IsInGOPATH != "" || pkg.IsVendored || pkg.IsMirrored
+	}
+	target := strings.Trim(dep, "\"")
+	return !isDir(filepath.Join(GOROOT, "src", "pkg", target))
+}
+
+// TryAudit lists the external imports of each relevant target, and whether
+// the policy allows them.
+func TryAudit() {
+	if !Audit {
+		return
+	}
+
+	var targets []string
+	byTarget := make(map[string]*Package)
+	for _, pkg := range ListedPkgs {
+		if pkg.IsVendored || pkg.IsMirrored {
+			continue
+		}
+		targets = append(targets, pkg.Target)
+		byTarget[pkg.Target] = pkg
+	}
+	sort.StringSlice(targets).Sort()
+
+	for _, target := range targets {
+		pkg := byTarget[target]
+		deps := append(append([]string{}, pkg.Deps...), pkg.TestDeps...)
+		deps = RemoveDups(deps)
+		sort.StringSlice(deps).Sort()
+
+		var lines []string
+		for _, dep := range deps {
+			if dep == "\"C\"" || !IsExternalImport(dep) {
+				continue
+			}
+			status := "allowed"
+			if ok, why := CheckPolicy(dep); !ok {
+				status = why
+			}
+			lines = append(lines, fmt.Sprintf(" %s (%s) in %s", dep, status, pkg.ImportingFile(dep)))
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Printf("in %s: \"%s\"\n", pkg.Dir, pkg.Target)
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	}
+}
@@ -30,6 +30,12 @@ var OSWD, CWD string
 var GCFLAGS, GLDFLAGS []string
 
 var GOPATH, GOPATH_SINGLE string
+
+// the $GOPATH entry that workspace targets are installed into
+var GOPATH_INSTALL string
+
+// names the $GOPATH entry to install into, unless $GB_INSTALL_GOPATH does
+var InstallGOPATHFile = "gopath.gb"
 var GOPATHS, GOPATH_SRCROOTS, GOPATH_OBJDSTS, GOPATH_CFLAGS, GOPATH_LDFLAGS []string
 
 var ValidGOARCHs = map[string]bool{
@@ -142,6 +148,16 @@ func LoadEnvs() bool {
 		}
 	}
 
+	var err os.Error
+	if GOPATH_INSTALL, err = InstallGOPATH(os.Getenv("GB_INSTALL_GOPATH")); err != nil {
+		ErrLog.Printf("%v", err)
+		return false
+	}
+
+	if MirrorDir = os.Getenv("GB_MIRROR"); MirrorDir != "" {
+		MirrorDir = GetAbs(MirrorDir, OSWD)
+	}
+
 	gcFlagsStr, gldFlagsStr := os.Getenv("GB_GCFLAGS"), os.Getenv("GB_GLDFLAGS")
 	if gcFlagsStr != "" {
 		GCFLAGS = append(GCFLAGS, strings.Fields(gcFlagsStr)...)
@@ -160,13 +176,33 @@ func LoadEnvs() bool {
 	return true
 }
 
+// InstallGOPATH picks the $GOPATH entry to install into: the one named, by
+// $GB_INSTALL_GOPATH, or else the one in gopath.gb, or else the first.
+func InstallGOPATH(named string) (gp string, err os.Error) {
+	if named != "" {
+		named = GetAbs(named, OSWD)
+	} else if line, rerr := ReadOneLine(filepath.Join(CWD, InstallGOPATHFile)); rerr == nil && line != "" {
+		named = GetAbs(line, CWD)
+	}
+	if named == "" {
+		return GOPATH_SINGLE, nil
+	}
+	for _, entry := range GOPATHS {
+		if GetAbs(entry, OSWD) == named {
+			return entry, nil
+		}
+	}
+	err = os.NewError(fmt.Sprintf("Can't install into %s, it isn't an entry in $GOPATH", named))
+	return
+}
+
 func GetBuildDirPkg() (dir string) {
 	return "_obj"
 }
 
 func GetInstallDirPkg() (dir string) {
-	if GOPATH_SINGLE != "" {
-		return filepath.Join(GOPATH_SINGLE, "pkg", GOOS+"_"+GOARCH)
+	if GOPATH_INSTALL != "" {
+		return filepath.Join(GOPATH_INSTALL, "pkg", GOOS+"_"+GOARCH)
 	}
 	return filepath.Join(GOROOT, "pkg", GOOS+"_"+GOARCH)
 }
@@ -176,8 +212,8 @@ func GetBuildDirCmd() (dir string) {
 }
 
 func GetInstallDirCmd() (dir string) {
-	if GOPATH_SINGLE != "" {
-		return filepath.Join(GOPATH_SINGLE, "bin")
+	if GOPATH_INSTALL != "" {
+		return filepath.Join(GOPATH_INSTALL, "bin")
 	}
 	return GOBIN
 }
@@ -19,6 +19,7 @@ import (
 	"os"
 	"exec"
 	"fmt"
+	"bytes"
 	"strings"
 )
 
@@ -100,6 +101,14 @@ func SplitArgs(args []string) (sargs []string) {
 func RunExternalDump(cmd, wd string, argv []string, dump *os.File) (err os.Error) {
 	argv = SplitArgs(argv)
 
+	if ScriptFile != nil {
+		out := ""
+		if dump != os.Stdout {
+			out = dump.Name()
+		}
+		return ScriptCommand(wd, argv, out)
+	}
+
 	c := exec.Command(cmd, argv[1:]...)
 	c.Dir = wd
 	c.Env = os.Environ()
@@ -121,3 +130,46 @@ func RunExternalDump(cmd, wd string, argv []string, dump *os.File) (err os.Error
 func RunExternal(cmd, wd string, argv []string) (err os.Error) {
 	return RunExternalDump(cmd, wd, argv, os.Stdout)
 }
+func RunExternalToFile(cmd, wd string, argv []string, out string) (err os.Error) {
+	if ScriptFile != nil {
+		return ScriptCommand(wd, SplitArgs(argv), out)
+	}
+	var dump *os.File
+	dump, err = os.Create(out)
+	if err != nil {
+		return
+	}
+	defer dump.Close()
+	err = RunExternalDump(cmd, wd, argv, dump)
+	return
+}
+
+// RunExternalOutput runs argv[0], found in the path, and returns what it
+// printed. It is meant for querying tools, so it is never written to a
+// build script.
+func RunExternalOutput(wd string, argv []string) (out string, err os.Error) {
+	var cmd string
+	if cmd, err = exec.LookPath(argv[0]); err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	c := exec.Command(cmd, argv[1:]...)
+	c.Dir = wd
+	c.Env = os.Environ()
+
+	c.Stdout = &buf
+	c.Stderr = os.Stderr
+
+	err = c.Run()
+
+	if wmsg, ok := err.(*os.Waitmsg); ok {
+		if wmsg.ExitStatus() != 0 {
+			err = os.NewError(fmt.Sprintf("%v: %s\n", argv, wmsg.String()))
+		} else {
+			err = nil
+		}
+	}
+	out = buf.String()
+	return
+}
@@ -0,0 +1,188 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"path/filepath"
+)
+
+// when non-nil, external commands are written to this file instead of being run
+var ScriptFile *os.File
+
+var ScriptName = "build.sh"
+
+func ShellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if strings.IndexAny(arg, " \t\n'\"\\$`*?[]{}()<>|&;#~!=") == -1 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// ScriptArg quotes an argument for the build script, leaving any reference
+// to $GOROOT for the shell to expand.
+func ScriptArg(arg string) string {
+	if GOROOT == "" || !strings.Contains(arg, GOROOT) {
+		return ShellQuote(arg)
+	}
+	var pieces []string
+	for _, piece := range strings.Split(arg, GOROOT) {
+		if piece == "" {
+			pieces = append(pieces, "")
+			continue
+		}
+		pieces = append(pieces, ShellQuote(piece))
+	}
+	return strings.Join(pieces, `"$GOROOT"`)
+}
+
+func ScriptLine(format string, args ...interface{}) (err os.Error) {
+	_, err = fmt.Fprintf(ScriptFile, format+"\n", args...)
+	return
+}
+
+func ScriptCommand(wd string, argv []string, out string) (err os.Error) {
+	var qargs []string
+	for _, arg := range argv {
+		qargs = append(qargs, ScriptArg(arg))
+	}
+	line := strings.Join(qargs, " ")
+	if out != "" {
+		line += " > " + ShellQuote(GetRelative(wd, out, CWD))
+	}
+	if wd != "." && wd != "" {
+		line = fmt.Sprintf("(cd %s && %s)", ShellQuote(wd), line)
+	}
+	return ScriptLine("%s", line)
+}
+
+func RunMkdirAll(dir string) (err os.Error) {
+	if ScriptFile != nil {
+		return ScriptLine("mkdir -p %s", ShellQuote(dir))
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+func RunRename(src, dst string) (err os.Error) {
+	if ScriptFile != nil {
+		return ScriptLine("mv -f %s %s", ShellQuote(src), ShellQuote(dst))
+	}
+	return os.Rename(src, dst)
+}
+
+func RunRemove(p string) (err os.Error) {
+	if ScriptFile != nil {
+		return ScriptLine("rm -f %s", ShellQuote(p))
+	}
+	return os.Remove(p)
+}
+
+func TryGenScript() (err os.Error) {
+	if !GenScript {
+		return
+	}
+
+	if _, ferr := os.Stat(ScriptName); ferr == nil {
+		if !Force {
+			fmt.Printf("'%s' exists; overwrite? (y/n) ", ScriptName)
+			var answer string
+			fmt.Scanf("%s", &answer)
+			if answer != "y" && answer != "Y" {
+				return
+			}
+		}
+		os.Remove(ScriptName)
+	}
+
+	fmt.Printf("(in .) generating %s\n", ScriptName)
+
+	ScriptFile, err = os.Create(ScriptName)
+	if err != nil {
+		return
+	}
+	// the script has to list the commands in dependence order, so the
+	// targets are built one at a time whatever -p says
+	concurrent := Concurrent
+	Concurrent = false
+	defer func() {
+		if err != nil {
+			// don't leave half a script behind to be run
+			ScriptFile.Close()
+			os.Remove(ScriptName)
+		}
+		ScriptFile = nil
+		Concurrent = concurrent
+	}()
+
+	ScriptLine("#!/bin/sh")
+	ScriptLine("# Build script generated by gb: http://go-gb.googlecode.com")
+	ScriptLine("# gb provides configuration-free building and distributing")
+	ScriptLine("#")
+	ScriptLine("# The commands below are the ones gb would run, in topological")
+	ScriptLine("# dependence order. Neither gb nor make is needed to run them.")
+	ScriptLine("")
+	ScriptLine("set -e")
+	ScriptLine("cd \"`dirname \"$0\"`\"")
+	ScriptLine(": ${GOROOT:=%s}", ShellQuote(GOROOT))
+	ScriptLine("export GOROOT")
+	ScriptLine("")
+
+	// every workspace target in the plan is rebuilt from scratch, so forget
+	// what is on disk for the duration and put it back afterwards
+	needsBuild := make(map[*Package]bool)
+	for _, pkg := range Packages {
+		if pkg.IsInGOROOT || pkg.IsInGOPATH != "" {
+			continue
+		}
+		needsBuild[pkg] = pkg.NeedsBuild
+		pkg.NeedsBuild = true
+		pkg.BinTime = 0
+	}
+
+	for _, pkg := range ListedPkgs {
+		if err = pkg.Build(); err != nil {
+			break
+		}
+	}
+
+	for pkg, nb := range needsBuild {
+		pkg.built = false
+		pkg.Stat()
+		pkg.NeedsBuild = nb
+		pkg.CheckStatus()
+	}
+	PackagesBuilt = 0
+	if err != nil {
+		return
+	}
+
+	if err = ScriptLine("\necho Done"); err != nil {
+		return
+	}
+
+	if err = ScriptFile.Close(); err != nil {
+		return
+	}
+
+	err = os.Chmod(filepath.Join(CWD, ScriptName), 0755)
+	return
+}
@@ -0,0 +1,122 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// EditDistance is the Levenshtein distance between a and b.
+func EditDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// ImportSuggestions lists workspace targets that an unresolved import might
+// have meant: those with a name a few edits away or with the same last
+// element, and those in the directory named by the import but renamed with
+// target.gb or a //target: comment.
+func ImportSuggestions(dep string) (suggestions []string) {
+	target := strings.Trim(dep, "\"")
+	seen := make(map[string]bool)
+	suggest := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			suggestions = append(suggestions, s)
+		}
+	}
+
+	maxEdits := len(target) / 4
+	if maxEdits < 2 {
+		maxEdits = 2
+	}
+
+	var renamed, near []string
+	for _, pkg := range AllTargets().Sorted() {
+		if pkg.IsCmd || pkg.IsInGOROOT {
+			continue
+		}
+		switch {
+		case pkg.Dir == target && pkg.Target != target:
+			renamed = append(renamed, fmt.Sprintf("\"%s\", the target in %s", pkg.Target, pkg.Dir))
+		case EditDistance(pkg.Target, target) <= maxEdits:
+			near = append(near, fmt.Sprintf("\"%s\"", pkg.Target))
+		case path.Base(pkg.Target) == path.Base(target):
+			near = append(near, fmt.Sprintf("\"%s\"", pkg.Target))
+		}
+	}
+	sort.StringSlice(near).Sort()
+	for _, s := range renamed {
+		suggest(s)
+	}
+	for _, s := range near {
+		suggest(s)
+	}
+	return
+}
+
+// ReportUnresolved explains each import that ResolveDeps couldn't find, and
+// says how many there were.
+func ReportUnresolved() (unresolved int) {
+	for _, pkg := range AllTargets().Sorted() {
+		if pkg.IsInGOROOT || !pkg.Active {
+			continue
+		}
+		for _, dep := range RemoveDups(pkg.Unresolved) {
+			file := pkg.ImportingFile(dep)
+			if line := ImportLine(file, dep); line != 0 {
+				file = fmt.Sprintf("%s:%d", file, line)
+			}
+			ErrLog.Printf("%s: can't resolve import %s\n", file, dep)
+			unresolved++
+			if IsGoInstallable(dep) {
+				fmt.Fprintf(os.Stderr, "\tit looks like a remote package that hasn't been goinstalled; -g would fetch it\n")
+			} else {
+				fmt.Fprintf(os.Stderr, "\tit isn't a workspace target, nor installed in $GOROOT or $GOPATH\n")
+			}
+			for _, s := range ImportSuggestions(dep) {
+				fmt.Fprintf(os.Stderr, "\tdid you mean %s?\n", s)
+			}
+		}
+	}
+	return
+}
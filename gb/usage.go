@@ -23,15 +23,19 @@ import (
 var UsageText = `Usage: gb [options] [directory list]
 Options:
  -? print this usage text
+ -A list the imports from outside the workspace and $GOROOT, per target
  -b build after cleaning
  -c clean
  -C build/clean/install only cmds
  -D create distribution
  -e exclusive target list (do not build/clean/test/install a target unless it
     resides in a listed directory)
+ -E explain why each target needs building or installing
  -f force overwrite of existing makefiles
  -F run gofmt on source files in targeted directories
  -i install
+ -k verify remote packages against lock.gb before building
+ -K write lock.gb, recording the remote packages in use
  -L scan and list targets and their source files
  -m use makefiles, when possible
  -M generate standard makefiles without building
@@ -44,8 +48,27 @@ Options:
  -s scan and list targets without building
  -S scan and list targets and their dependencies without building
  -t run tests
+ -u name pkgs by their git/hg remote url and path in the repository
+ -U rewrite stale makefiles that gb generated
  -v verbose
+ -V copy the source of remote packages into vendor/ without building
  -W create workspace.gb files in all directories
+ -X generate a standalone build script, build.sh, without building
+Long options:
+ --query=EXPR print the targets EXPR selects, e.g.
+    "kind(cmd, rdeps(pkg/auth) - rdeps(pkg/legacy))", without building
+ --format=names|dirs|json how --query prints targets
+ --path=FROM,TO print the shortest chain of imports from FROM to TO
+ --allpaths=FROM,TO print every chain of imports from FROM to TO
+ --files=text|json|dot print the imports of each source file
+ --singleuse list the imports that only one file in a package makes
+ --unreachable list the pkgs no cmd, or with -t no test, depends on
+ --since=REV only build, test or install the targets affected by changes
+    since the git revision REV
+ --graphdiff=REV1[..REV2] print how the target graph changed between two git
+    revisions, or since REV1
+ --bisect=GOOD[..BAD] find the first commit after GOOD where the build, or
+    with -t the tests, breaks
 `
 
 func Usage() {
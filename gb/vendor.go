@@ -0,0 +1,130 @@
+/* 
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"path/filepath"
+)
+
+// remote packages are copied to VendorDir/<import path>, and targets found
+// there are named by their import path
+var VendorDir = "vendor"
+
+// FindRemoteSource returns the directory that goinstall keeps the source for
+// target in.
+func FindRemoteSource(target string) (dir string, err os.Error) {
+	target = strings.Trim(target, "\"")
+	srcroots := append([]string{}, GOPATH_SRCROOTS...)
+	srcroots = append(srcroots, filepath.Join(GOROOT, "src", "pkg"))
+	for _, srcroot := range srcroots {
+		dir = filepath.Join(srcroot, target)
+		if info, serr := os.Stat(dir); serr == nil && info.IsDirectory() {
+			return
+		}
+	}
+	dir = ""
+	err = os.NewError(fmt.Sprintf("could not find the source for \"%s\" (try -g)", target))
+	return
+}
+
+func TryVendor() (err os.Error) {
+	if !Vendor {
+		return
+	}
+
+	var todo []string
+	seen := make(map[string]bool)
+	want := func(deps []string) {
+		for _, dep := range deps {
+			if IsGoInstallable(dep) && !seen[dep] {
+				seen[dep] = true
+				todo = append(todo, dep)
+			}
+		}
+	}
+
+	visited := make(map[*Package]bool)
+	var visit func(pkg *Package)
+	visit = func(pkg *Package) {
+		if visited[pkg] {
+			return
+		}
+		visited[pkg] = true
+		want(pkg.Deps)
+		if Test {
+			want(pkg.TestDeps)
+		}
+		for _, dp := range pkg.DepPkgs {
+			visit(dp)
+		}
+	}
+	for _, pkg := range ListedPkgs {
+		visit(pkg)
+	}
+
+	vendored := 0
+	for len(todo) != 0 {
+		dep := todo[0]
+		todo = todo[1:]
+
+		if pkg, ok := LookupImport(dep); ok && !pkg.IsInGOROOT && pkg.IsInGOPATH == "" {
+			// already part of the workspace
+			visit(pkg)
+			continue
+		}
+
+		target := strings.Trim(dep, "\"")
+		var src string
+		src, err = FindRemoteSource(target)
+		if err != nil && GoInstall {
+			GoInstallPkg(dep)
+			src, err = FindRemoteSource(target)
+		}
+		if err != nil {
+			return
+		}
+
+		dst := filepath.Join(VendorDir, target)
+		fmt.Printf("Vendoring \"%s\" from %s\n", target, src)
+		if err = os.RemoveAll(dst); err != nil {
+			return
+		}
+		if err = CopyDir(src, dst); err != nil {
+			return
+		}
+		vendored++
+
+		// the copy may import other remote packages
+		pkg, perr := NewPackage(target, dst)
+		if perr != nil {
+			ErrLog.Printf("(in %s) %v\n", dst, perr)
+			continue
+		}
+		want(pkg.Deps)
+	}
+
+	if vendored == 1 {
+		fmt.Printf("Vendored 1 package into %s\n", VendorDir)
+	} else {
+		fmt.Printf("Vendored %d packages into %s\n", vendored, VendorDir)
+	}
+
+	return
+}